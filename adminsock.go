@@ -0,0 +1,152 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Flags.
+var (
+	adminSocket    = flag.String("admin_socket", "", "If non-empty, path of a Unix socket (e.g. /run/runsit/admin.sock) to also serve the admin interface on. Callers are identified by SO_PEERCRED.")
+	adminOperators = flag.String("admin_operators", "root,@operators", "Comma-separated users and @groups who may change tasks via --admin_socket. Other callers get read-only access.")
+)
+
+// peerCred is the identity of the process on the other end of a Unix
+// socket connection.
+type peerCred struct {
+	pid, uid, gid int
+	groups        []int // supplementary; may be nil if unknown
+}
+
+type peerCredKey struct{}
+
+// adminACL says who may change tasks over the admin socket.
+type adminACL struct {
+	uids map[int]bool
+	gids map[int]bool
+}
+
+// parseAdminACL parses a --admin_operators value. Unknown users and
+// groups are logged and skipped.
+func parseAdminACL(s string) *adminACL {
+	acl := &adminACL{uids: map[int]bool{}, gids: map[int]bool{}}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case strings.HasPrefix(name, "@"):
+			gid, err := LookupGroupId(name[1:])
+			if err != nil {
+				logger.Printf("admin_operators: skipping group %q: %v", name[1:], err)
+				continue
+			}
+			acl.gids[gid] = true
+		default:
+			u, err := user.Lookup(name)
+			if err != nil {
+				logger.Printf("admin_operators: skipping user %q: %v", name, err)
+				continue
+			}
+			acl.uids[atoi(u.Uid)] = true
+		}
+	}
+	return acl
+}
+
+// mayMutate reports whether the peer may change tasks.
+func (acl *adminACL) mayMutate(pc *peerCred) bool {
+	if acl.uids[pc.uid] || acl.gids[pc.gid] {
+		return true
+	}
+	for _, gid := range pc.groups {
+		if acl.gids[gid] {
+			return true
+		}
+	}
+	return false
+}
+
+// handler wraps h, allowing only read-only requests from peers not
+// in acl.
+func (acl *adminACL) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pc, _ := r.Context().Value(peerCredKey{}).(*peerCred)
+		if pc == nil {
+			adminError(w, r, http.StatusForbidden, "unknown peer credentials")
+			return
+		}
+		if isMutating(r) && !acl.mayMutate(pc) {
+			logger.Printf("admin socket: denied %s %s from uid %d (pid %d)", r.Method, r.URL, pc.uid, pc.pid)
+			adminError(w, r, http.StatusForbidden, fmt.Sprintf("uid %d may not change tasks", pc.uid))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// listenAdminSocket listens on the Unix socket at path.
+func listenAdminSocket(path string) net.Listener {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logger.Fatalf("admin socket: %v", err)
+	}
+	// Remove any socket left behind by a previous runsit.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		logger.Fatalf("admin socket: %v", err)
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		logger.Fatalf("admin socket: %v", err)
+	}
+	logger.Printf("Listening on admin socket %s", path)
+	return ln
+}
+
+// runAdminSocket serves the admin interface on ln, the admin socket.
+// Anyone who can connect may read; only operators may change tasks.
+func runAdminSocket(ln net.Listener) {
+	acl := parseAdminACL(*adminOperators)
+	s := &http.Server{
+		Handler: acl.handler(checkMutation(adminHandler())),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			uc, ok := c.(*net.UnixConn)
+			if !ok {
+				return ctx
+			}
+			pc, err := getPeerCred(uc)
+			if err != nil {
+				logger.Printf("admin socket: %v", err)
+				return ctx
+			}
+			return context.WithValue(ctx, peerCredKey{}, pc)
+		},
+	}
+	if err := s.Serve(ln); err != nil {
+		logger.Fatalf("admin socket server exiting: %v", err)
+	}
+}
@@ -0,0 +1,585 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Adopting instances after runsit restarts. With --state_dir, runsit
+// records each running instance in DIR/state.json: its PID and process
+// group, when the process started (so a reused PID isn't mistaken for
+// it), and a hash of its task's config. The instance's stdout, stderr
+// and notify FD are FIFOs in a directory of its own under DIR rather
+// than pipes. The instance holds each FIFO open for both reading and
+// writing, so if runsit dies its writes are buffered (blocking once a
+// FIFO is full) rather than failing with EPIPE.
+//
+// When runsit starts, it reads the state file. Each task's live
+// instance is adopted once the task's config is loaded: runsit reopens
+// its FIFOs, takes back its port listeners (on Linux 5.6 and later)
+// and manages it as if it had started it, except that its exit status
+// can't be known. An adopted instance whose config has since changed
+// is stopped and replaced. Instances whose config file is gone or
+// invalid are killed.
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+var stateDir = flag.String("state_dir", "", "If non-empty, directory (e.g. /run/runsit) in which to record running instances, so that a restarted runsit adopts them rather than starting duplicates.")
+
+// instanceRecord is a running instance, as recorded in the state file.
+type instanceRecord struct {
+	Task       string
+	Pid        int
+	Pgid       int
+	ProcStart  uint64    // process start time in clock ticks since boot, or 0 if unknown
+	Started    time.Time // the TaskInstance's startTime
+	ConfigHash string
+	Dir        string // holding the instance's FIFOs
+	Cgroup     string // the instance's cgroup directory, or ""
+
+	up *instanceHandover // if handed over by an upgrade; see upgrade.go
+}
+
+var (
+	stateMu sync.Mutex
+	records = map[int]*instanceRecord{}      // pid -> record of each running instance, guarded by stateMu
+	orphans = map[string][]*instanceRecord{} // task name -> live instances not yet adopted, newest first, guarded by stateMu
+)
+
+// errAdoptedExit is the waitErr of an adopted instance.
+var errAdoptedExit = errors.New("adopted instance exited; exit status unknown")
+
+func stateFile() string {
+	return filepath.Join(*stateDir, "state.json")
+}
+
+// configHash returns a hash of a config file's contents.
+func configHash(jc jsonconfig.Obj) string {
+	b, err := json.Marshal(jc)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:16]
+}
+
+// saveStateLocked writes the state file. stateMu must be held.
+func saveStateLocked() {
+	if *stateDir == "" {
+		return
+	}
+	list := []*instanceRecord{}
+	for _, r := range records {
+		list = append(list, r)
+	}
+	sort.Sort(byRecordPid(list))
+	b, err := json.MarshalIndent(list, "", "\t")
+	tmp := stateFile() + ".tmp"
+	if err == nil {
+		err = ioutil.WriteFile(tmp, b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, stateFile())
+	}
+	if err != nil {
+		logger.Printf("Error writing state file: %v", err)
+	}
+}
+
+type byRecordPid []*instanceRecord
+
+func (s byRecordPid) Len() int           { return len(s) }
+func (s byRecordPid) Less(i, j int) bool { return s[i].Pid < s[j].Pid }
+func (s byRecordPid) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// recordInstance adds a newly started instance to the state file.
+func recordInstance(in *TaskInstance) {
+	if *stateDir == "" {
+		return
+	}
+	start, _, err := procIdentity(in.Pid())
+	if err != nil {
+		in.Printf("Can't record process start time: %v", err)
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	records[in.Pid()] = &instanceRecord{
+		Task:       in.task.Name,
+		Pid:        in.Pid(),
+		Pgid:       in.Pid(),
+		ProcStart:  start,
+		Started:    in.startTime,
+		ConfigHash: in.config.hash,
+		Dir:        in.io.dir,
+		Cgroup:     in.cgroupDir(),
+	}
+	saveStateLocked()
+}
+
+// forgetInstance removes an exited instance from the state file.
+func forgetInstance(in *TaskInstance) {
+	if *stateDir == "" {
+		return
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if r, ok := records[in.Pid()]; ok && r.Started.Equal(in.startTime) {
+		delete(records, in.Pid())
+		saveStateLocked()
+	}
+}
+
+// alive reports whether the recorded process is still running.
+func (r *instanceRecord) alive() bool {
+	start, pgid, err := procIdentity(r.Pid)
+	return err == nil && pgid == r.Pgid && (r.ProcStart == 0 || start == r.ProcStart)
+}
+
+// loadState reads the state file left by the previous runsit, if
+// any, and kills the live instances whose config file is gone. The
+// rest wait in orphans to be adopted by their tasks.
+func loadState() {
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		logger.Fatalf("Error creating --state_dir: %v", err)
+	}
+	var list []*instanceRecord
+	b, err := ioutil.ReadFile(stateFile())
+	if err == nil {
+		err = json.Unmarshal(b, &list)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("Ignoring unreadable state file: %v", err)
+	}
+	var kill []*instanceRecord
+	stateMu.Lock()
+	for _, r := range list {
+		if !r.alive() {
+			logger.Printf("Instance of %q with PID %d exited while runsit wasn't running", r.Task, r.Pid)
+			continue
+		}
+		records[r.Pid] = r
+		base := replicaBase(r.Task)
+		if _, err := os.Stat(filepath.Join(*configDir, base+".json")); os.IsNotExist(err) {
+			kill = append(kill, r)
+			continue
+		}
+		logger.Printf("Found instance of %q with PID %d from before runsit restarted", r.Task, r.Pid)
+		orphans[r.Task] = append(orphans[r.Task], r)
+	}
+	for _, rs := range orphans {
+		sort.Sort(byRecordStarted(rs))
+	}
+	saveStateLocked()
+	stateMu.Unlock()
+
+	for _, r := range kill {
+		r.kill("its config file is gone")
+	}
+	removeStaleDirs()
+}
+
+type byRecordStarted []*instanceRecord
+
+func (s byRecordStarted) Len() int           { return len(s) }
+func (s byRecordStarted) Less(i, j int) bool { return s[i].Started.After(s[j].Started) }
+func (s byRecordStarted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// removeStaleDirs removes the FIFO directories of instances that
+// aren't running.
+func removeStaleDirs() {
+	fis, err := ioutil.ReadDir(*stateDir)
+	if err != nil {
+		return
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	inUse := map[string]bool{}
+	for _, r := range records {
+		inUse[r.Dir] = true
+	}
+	for _, fi := range fis {
+		dir := filepath.Join(*stateDir, fi.Name())
+		if fi.IsDir() && !inUse[dir] {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// claimOrphans returns the live instances of the named task left by
+// the previous runsit, newest first, and forgets them as orphans.
+func claimOrphans(name string) []*instanceRecord {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	rs := orphans[name]
+	delete(orphans, name)
+	return rs
+}
+
+// killOrphans kills the named task's instances left by the previous
+// runsit.
+func killOrphans(name, reason string) {
+	for _, r := range claimOrphans(name) {
+		r.kill(reason)
+	}
+}
+
+// killSurplusOrphans kills the instances left by the previous runsit
+// of replicas n and above of the task named base.
+func killSurplusOrphans(base string, n int) {
+	stateMu.Lock()
+	var names []string
+	for name := range orphans {
+		i, err := strconv.Atoi(strings.TrimPrefix(name, base+replicaSep))
+		if strings.HasPrefix(name, base+replicaSep) && err == nil && i >= n {
+			names = append(names, name)
+		}
+	}
+	stateMu.Unlock()
+	for _, name := range names {
+		killOrphans(name, fmt.Sprintf("config now has %d instances", n))
+	}
+}
+
+// kill stops an instance that won't be adopted, sending SIGTERM and
+// then SIGKILL to its process group, and killing its cgroup, if any.
+func (r *instanceRecord) kill(reason string) {
+	logger.Printf("Killing PID %d of %q from before runsit restarted: %s", r.Pid, r.Task, reason)
+	stateMu.Lock()
+	delete(records, r.Pid)
+	saveStateLocked()
+	stateMu.Unlock()
+	syscall.Kill(-r.Pgid, syscall.SIGTERM)
+	if r.child() {
+		go func() {
+			if p, err := os.FindProcess(r.Pid); err == nil {
+				p.Wait()
+			}
+			forgetChild(r.Pid)
+		}()
+	}
+	go func() {
+		time.Sleep(10 * time.Second)
+		if r.alive() {
+			syscall.Kill(-r.Pgid, syscall.SIGKILL)
+		}
+		if r.Cgroup != "" {
+			cg := &cgroup{r.Cgroup}
+			cg.killAll()
+			cg.remove()
+		}
+		os.RemoveAll(r.Dir)
+	}()
+}
+
+// child reports whether the recorded instance is runsit's own child,
+// handed over by an upgrade, rather than left by a previous runsit.
+func (r *instanceRecord) child() bool {
+	return r.up != nil && r.up.Child
+}
+
+// adoptOrphans adopts the task's live instances left by the previous
+// runsit, if any, and reports whether there were any. Of those read
+// from the state file, only the newest is adopted and the others are
+// killed; those handed over by an upgrade keep their roles.
+//
+// run in Task.loop
+func (t *Task) adoptOrphans(tc *taskConfig) bool {
+	rs := claimOrphans(t.Name)
+	if len(rs) == 0 {
+		return false
+	}
+	for i, r := range rs {
+		role := roleRunning
+		if r.up != nil {
+			role = r.up.Role
+		} else if i > 0 {
+			r.kill("a newer instance was adopted")
+			continue
+		}
+		in, err := t.adoptInstance(r, tc)
+		if err != nil {
+			r.kill(fmt.Sprintf("can't adopt it: %v", err))
+			continue
+		}
+		switch role {
+		case rolePrevious:
+			t.previous = in
+		case roleStopping:
+			in.stopTime = r.up.StopTime
+			in.mu.Lock()
+			in.stopReason = r.up.StopReason
+			in.mu.Unlock()
+			in.stopKind = r.up.StopKind
+			t.stopping = in
+			go in.awaitStop()
+		default:
+			t.running = in
+		}
+	}
+	in := t.running
+	if in == nil {
+		if t.stopping == nil {
+			return false
+		}
+		t.setState(StateStopping, "adopted stopping instance after %s", t.stopping.adopted.cause())
+		t.startPending = !t.operatorStopped
+		return true
+	}
+	r := in.adopted
+	if r.ConfigHash != tc.hash {
+		t.stopAll(fmt.Sprintf("config changed since it started, before %s", r.cause()))
+		if tc.schedule != nil {
+			t.scheduleRun()
+		} else {
+			t.startPending = true
+		}
+		return true
+	}
+	if r.up == nil {
+		for i, p := range tc.ports {
+			lf, err := takeListener(r.Pid, 3+i)
+			if err != nil {
+				in.Printf("Can't take back listener for port %q: %v; reopening it at the next start", p.name, err)
+				continue
+			}
+			if t.listeners == nil {
+				t.listeners = make(map[string]*os.File)
+			}
+			t.listeners[p.addr] = lf
+		}
+	}
+	if tc.health != nil {
+		go in.checkHealth(tc.health)
+	}
+	if tc.watchdog > 0 {
+		in.watchdogTime = time.Now()
+		in.scheduleWatchdogCheck(tc.watchdog)
+	}
+	if tc.maxRuntime > 0 {
+		in.scheduleMaxRuntime(tc.maxRuntime - time.Now().Sub(r.Started))
+	}
+	switch {
+	case tc.oneshot:
+		t.setState(StateStarting, "adopted PID %d after %s", in.Pid(), r.cause())
+		if tc.schedule != nil {
+			t.scheduleRun()
+		}
+	case !in.ready:
+		t.setState(StateStarting, "adopted PID %d after %s; waiting for READY=1", in.Pid(), r.cause())
+	default:
+		t.setState(StateRunning, "adopted PID %d after %s", in.Pid(), r.cause())
+	}
+	return true
+}
+
+// adoptInstance returns a TaskInstance for the recorded instance r,
+// watching its output and waiting for it to exit. Its config is
+// assumed to be tc.
+//
+// run in Task.loop
+func (t *Task) adoptInstance(r *instanceRecord, tc *taskConfig) (*TaskInstance, error) {
+	var sio *instanceIO
+	if r.up != nil {
+		sio = r.up.io()
+	} else {
+		var err error
+		if sio, err = reopenInstanceIO(r.Dir); err != nil {
+			return nil, fmt.Errorf("can't reopen its output: %v", err)
+		}
+	}
+	proc, err := os.FindProcess(r.Pid)
+	if err != nil {
+		sio.close()
+		return nil, err
+	}
+	in := &TaskInstance{
+		task:        t,
+		config:      tc,
+		startTime:   r.Started,
+		lr:          tc.lr,
+		cmd:         &exec.Cmd{Process: proc},
+		io:          sio,
+		adopted:     r,
+		stopSignal:  tc.stopSignal,
+		stopTimeout: tc.stopTimeout,
+		done:        make(chan struct{}),
+		ready:       true,
+	}
+	if r.Cgroup != "" {
+		in.cgroup = &cgroup{r.Cgroup}
+	}
+	if up := r.up; up != nil {
+		in.ready = up.Ready || !tc.notify
+		in.statusText = up.StatusText
+		in.output.restore(in, up.Output)
+	} else {
+		t.starts++
+	}
+	trackProcessTree(in.Pid())
+	for _, p := range []struct {
+		f    *os.File
+		name string
+	}{{sio.outr, "stdout"}, {sio.errr, "stderr"}} {
+		if p.f != nil {
+			go in.watchPipe(p.f, p.name)
+		}
+	}
+	go in.awaitDeath()
+	if sio.notifyr != nil {
+		go in.watchNotify(sio.notifyr)
+	}
+	in.Printf("adopted after %s", r.cause())
+	return in, nil
+}
+
+// cause returns what r's instance was adopted after.
+func (r *instanceRecord) cause() string {
+	if r.up != nil {
+		return "runsit upgraded"
+	}
+	return "runsit restarted"
+}
+
+// awaitAdopted waits for an adopted instance's process to exit. Unless
+// it's still runsit's child, runsit can only poll and its exit status
+// isn't known.
+func (in *TaskInstance) awaitAdopted() error {
+	if in.adopted.child() {
+		ps, err := in.cmd.Process.Wait()
+		if err != nil {
+			return err
+		}
+		in.cmd.ProcessState = ps
+		if !ps.Success() {
+			return &exec.ExitError{ProcessState: ps}
+		}
+		return nil
+	}
+	for in.adopted.alive() {
+		time.Sleep(time.Second)
+	}
+	return errAdoptedExit
+}
+
+// instanceIO is an instance's stdout, stderr and notify FD: pipes or,
+// with --state_dir, FIFOs.
+type instanceIO struct {
+	dir string // holding the FIFOs, or ""
+
+	outr, errr, notifyr *os.File // runsit's ends
+	outw, errw, notifyw *os.File // the instance's ends, until it's started
+}
+
+// fifoNames are the FIFOs in an instance's directory.
+var fifoNames = []string{"stdout", "stderr", "notify"}
+
+// newInstanceIO returns the output and notify FDs for a new instance
+// of the named task.
+func newInstanceIO(name string) (_ *instanceIO, err error) {
+	sio := new(instanceIO)
+	rs := []**os.File{&sio.outr, &sio.errr, &sio.notifyr}
+	ws := []**os.File{&sio.outw, &sio.errw, &sio.notifyw}
+	defer func() {
+		if err != nil {
+			sio.closeChildEnds()
+			sio.close()
+		}
+	}()
+	if *stateDir == "" {
+		for i := range rs {
+			if *rs[i], *ws[i], err = os.Pipe(); err != nil {
+				return nil, err
+			}
+		}
+		return sio, nil
+	}
+	if sio.dir, err = ioutil.TempDir(*stateDir, name+"."); err != nil {
+		return nil, err
+	}
+	for i, fifo := range fifoNames {
+		path := filepath.Join(sio.dir, fifo)
+		if err = syscall.Mkfifo(path, 0600); err != nil {
+			return nil, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+		}
+		// Opening for reading without blocking first, so the open
+		// for writing doesn't block either.
+		if *rs[i], err = os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0); err != nil {
+			return nil, err
+		}
+		if *ws[i], err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+			return nil, err
+		}
+	}
+	return sio, nil
+}
+
+// reopenInstanceIO opens runsit's ends of the FIFOs in dir, of an
+// instance left by the previous runsit.
+func reopenInstanceIO(dir string) (sio *instanceIO, err error) {
+	sio = &instanceIO{dir: dir}
+	rs := []**os.File{&sio.outr, &sio.errr, &sio.notifyr}
+	for i, fifo := range fifoNames {
+		if *rs[i], err = os.OpenFile(filepath.Join(dir, fifo), os.O_RDONLY|syscall.O_NONBLOCK, 0); err != nil {
+			sio.close()
+			return nil, err
+		}
+	}
+	return sio, nil
+}
+
+// closeChildEnds closes runsit's copies of the instance's ends, once
+// it has started or failed to.
+func (sio *instanceIO) closeChildEnds() {
+	for _, f := range []*os.File{sio.outw, sio.errw, sio.notifyw} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// close closes runsit's ends, for an instance that failed to start,
+// and removes the FIFOs.
+func (sio *instanceIO) close() {
+	for _, f := range []*os.File{sio.outr, sio.errr, sio.notifyr} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	sio.remove()
+}
+
+// remove removes the FIFOs, once the instance has exited. Open ends
+// can still be read to EOF.
+func (sio *instanceIO) remove() {
+	if sio.dir != "" {
+		os.RemoveAll(sio.dir)
+	}
+}
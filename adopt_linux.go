@@ -0,0 +1,80 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procIdentity returns when process pid started, in clock ticks
+// since boot, and its process group. It fails if pid isn't running.
+func procIdentity(pid int) (start uint64, pgid int, err error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	rp := bytes.LastIndexByte(b, ')')
+	if rp < 0 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	f := strings.Fields(string(b[rp+1:]))
+	// f[0] is field 3 (state) in proc(5).
+	const (
+		fPgrp      = 5 - 3
+		fStartTime = 22 - 3
+	)
+	if len(f) <= fStartTime {
+		return 0, 0, fmt.Errorf("short /proc/%d/stat", pid)
+	}
+	if f[0] == "Z" {
+		return 0, 0, errors.New("process is a zombie")
+	}
+	pgid, _ = strconv.Atoi(f[fPgrp])
+	start, _ = strconv.ParseUint(f[fStartTime], 10, 64)
+	return start, pgid, nil
+}
+
+// Not yet in package syscall; the same on every architecture.
+const (
+	sysPidfdOpen  = 434
+	sysPidfdGetfd = 438
+)
+
+// takeListener returns a copy of process pid's file descriptor fd,
+// which must be a listening socket. It needs Linux 5.6 or later and
+// permission to ptrace pid.
+func takeListener(pid, fd int) (*os.File, error) {
+	pidfd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("pidfd_open", errno)
+	}
+	defer syscall.Close(int(pidfd))
+	nfd, _, errno := syscall.Syscall(sysPidfdGetfd, pidfd, uintptr(fd), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("pidfd_getfd", errno)
+	}
+	if v, err := syscall.GetsockoptInt(int(nfd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); err != nil || v == 0 {
+		syscall.Close(int(nfd))
+		return nil, fmt.Errorf("fd %d isn't a listening socket", fd)
+	}
+	return os.NewFile(nfd, fmt.Sprintf("pid%d-fd%d", pid, fd)), nil
+}
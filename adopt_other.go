@@ -0,0 +1,37 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// procIdentity returns process pid's process group. Its start time
+// isn't known, so is 0. It fails if pid isn't running.
+func procIdentity(pid int) (start uint64, pgid int, err error) {
+	pgid, err = syscall.Getpgid(pid)
+	return 0, pgid, err
+}
+
+// takeListener would copy a listening socket from process pid, which
+// only Linux supports.
+func takeListener(pid, fd int) (*os.File, error) {
+	return nil, errors.New("not supported on this OS")
+}
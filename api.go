@@ -0,0 +1,419 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// The JSON API, served under /api/v1/:
+//
+//   GET  /api/v1/tasks                  all tasks (apiTask, without failures or history)
+//   GET  /api/v1/tasks/NAME             one task (apiTask)
+//   GET  /api/v1/tasks/NAME/output      output lines (apiOutput); params:
+//                                         instance: instance ID (default: running instance)
+//                                         since: only lines with a greater seq (default 0)
+//                                         limit: max lines to return (default 1000)
+//   POST /api/v1/tasks/NAME/start       start a stopped or failed task
+//   POST /api/v1/tasks/NAME/stop        stop the task; param instance: required running instance ID
+//   POST /api/v1/tasks/NAME/restart     restart the task; param instance: as for stop
+//   POST /api/v1/upgrade                re-exec runsit's binary without stopping tasks
+//                                         (apiUpgrade; see upgrade.go)
+//
+// Errors are returned as an apiError with a non-2xx status.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1/"
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiUpgrade struct {
+	Binary string `json:"binary"` // being re-execed
+}
+
+type apiTask struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`               // "daemon" or "oneshot"
+	Schedule    string    `json:"schedule,omitempty"` // when a scheduled oneshot runs
+	State       string    `json:"state"`
+	StateSince  time.Time `json:"stateSince"`
+	StateReason string    `json:"stateReason,omitempty"`
+	Summary     string    `json:"summary"`
+	Health      string    `json:"health,omitempty"`     // running instance's health check result
+	Ready       bool      `json:"ready,omitempty"`      // running instance sent READY=1
+	StatusText  string    `json:"statusText,omitempty"` // running instance's last STATUS=
+	Replica     int       `json:"replica"`              // index among the config's instances
+	Replicas    int       `json:"replicas,omitempty"`   // the config's instances
+	Restarts    int       `json:"restarts"`
+	Hangs       int       `json:"hangs"` // instances stopped for missing a watchdog keepalive
+
+	StartError  string  `json:"startError,omitempty"`
+	StartInSec  float64 `json:"startInSec,omitempty"`
+	ConfigError string  `json:"configError,omitempty"` // rejected config; previous one still in use
+
+	Running  *apiInstance   `json:"running,omitempty"`
+	Previous *apiInstance   `json:"previous,omitempty"` // being replaced by running in a rolling restart
+	Stopping *apiInstance   `json:"stopping,omitempty"`
+	Failures []*apiInstance `json:"failures,omitempty"` // newest first
+	History  []apiEvent     `json:"history,omitempty"`  // newest first
+}
+
+type apiInstance struct {
+	ID        string     `json:"id"`
+	PID       int        `json:"pid"`
+	Argv      []string   `json:"argv,omitempty"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	ExitError string     `json:"exitError,omitempty"`
+	Lines     int64      `json:"lines"` // seq of its most recent output line
+	Stats     *apiStats  `json:"stats,omitempty"`
+	Exit      *apiExit   `json:"exit,omitempty"`
+}
+
+// apiExit describes how a finished instance ended.
+type apiExit struct {
+	Description string  `json:"description"`
+	Code        int     `json:"code"` // -1 if killed by a signal
+	Signal      string  `json:"signal,omitempty"`
+	CoreDumped  bool    `json:"coreDumped,omitempty"`
+	StopReason  string  `json:"stopReason,omitempty"` // why runsit stopped it, if it did
+	OOMKills    int     `json:"oomKills,omitempty"`   // processes in its cgroup killed by the OOM killer
+	DurationSec float64 `json:"durationSec"`
+	UserCPUSec  float64 `json:"userCPUSec"`
+	SysCPUSec   float64 `json:"sysCPUSec"`
+	MaxRSSBytes int64   `json:"maxRSSBytes"`
+	MajFaults   int64   `json:"majFaults"`
+}
+
+// apiStats is the last sample of a running instance's process tree.
+type apiStats struct {
+	Time      time.Time      `json:"time"`
+	Total     apiProcStats   `json:"total"`              // fdLimit is the main process's
+	NumFiles  int            `json:"numFiles,omitempty"` // configured FD limit
+	Processes []apiProcStats `json:"processes"`          // process tree, depth-first from the main process
+}
+
+type apiProcStats struct {
+	PID      int     `json:"pid"`
+	PPID     int     `json:"ppid"`
+	Depth    int     `json:"depth"` // in the process tree; orphans are 1
+	Comm     string  `json:"comm"`
+	RSSBytes int64   `json:"rssBytes"`
+	CPUSec   float64 `json:"cpuSec"`
+	Threads  int     `json:"threads"`
+	FDs      int     `json:"fds"`
+	FDLimit  int     `json:"fdLimit,omitempty"`
+}
+
+type apiEvent struct {
+	Time   time.Time `json:"time"`
+	State  string    `json:"state"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type apiOutput struct {
+	Instance string    `json:"instance"`
+	Lines    []apiLine `json:"lines"`
+}
+
+type apiLine struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"` // "stdout", "stderr", or "system"
+	Data    string    `json:"data"`
+	Partial bool      `json:"partial,omitempty"` // line was too long and truncated
+}
+
+func newAPITask(t *Task, st *TaskStatus, detail bool) *apiTask {
+	at := &apiTask{
+		Name:        t.Name,
+		Type:        "daemon",
+		Schedule:    st.Schedule,
+		State:       st.State.String(),
+		StateSince:  st.StateTime,
+		StateReason: st.StateReason,
+		Summary:     st.Summary(),
+		Health:      st.Health,
+		Ready:       st.Ready,
+		StatusText:  st.StatusText,
+		Replica:     st.Replica,
+		Replicas:    st.Replicas,
+		Restarts:    st.Restarts,
+		Hangs:       st.Hangs,
+		StartInSec:  st.StartIn.Seconds(),
+		Running:     newAPIInstance(st.Running),
+		Previous:    newAPIInstance(st.Previous),
+		Stopping:    newAPIInstance(st.Stopping),
+	}
+	if st.Oneshot {
+		at.Type = "oneshot"
+	}
+	if st.StartErr != nil {
+		at.StartError = st.StartErr.Error()
+	}
+	if st.ConfigErr != nil {
+		at.ConfigError = st.ConfigErr.Error()
+	}
+	if !detail {
+		return at
+	}
+	for i := len(st.Failures) - 1; i >= 0; i-- {
+		at.Failures = append(at.Failures, newAPIInstance(st.Failures[i]))
+	}
+	for i := len(st.History) - 1; i >= 0; i-- {
+		ev := st.History[i]
+		at.History = append(at.History, apiEvent{ev.T, ev.State.String(), ev.Reason})
+	}
+	return at
+}
+
+func newAPIInstance(in *TaskInstance) *apiInstance {
+	if in == nil {
+		return nil
+	}
+	ai := &apiInstance{
+		ID:        in.ID(),
+		PID:       in.Pid(),
+		Argv:      in.lr.Argv,
+		StartTime: in.startTime,
+		Lines:     in.output.count(),
+	}
+	if exited, end, err := in.Exited(); exited {
+		ai.EndTime = &end
+		if err != nil {
+			ai.ExitError = err.Error()
+		}
+		e := in.Exit()
+		ai.Exit = &apiExit{
+			Description: e.String(),
+			Code:        e.Code,
+			StopReason:  e.StopReason,
+			OOMKills:    e.OOMKills,
+			CoreDumped:  e.CoreDumped,
+			DurationSec: e.Duration.Seconds(),
+			UserCPUSec:  e.UserCPU.Seconds(),
+			SysCPUSec:   e.SysCPU.Seconds(),
+			MaxRSSBytes: e.MaxRSS,
+			MajFaults:   e.MajFaults,
+		}
+		if e.Signal != 0 {
+			ai.Exit.Signal = signalName(e.Signal)
+		}
+	}
+	if g := in.Stats(); g != nil {
+		ai.Stats = &apiStats{
+			Time:     g.Time,
+			Total:    newAPIProcStats(g.Total()),
+			NumFiles: in.lr.NumFiles,
+		}
+		for _, p := range g.Procs {
+			ai.Stats.Processes = append(ai.Stats.Processes, newAPIProcStats(p))
+		}
+	}
+	return ai
+}
+
+func newAPIProcStats(p procStats) apiProcStats {
+	return apiProcStats{
+		PID:      p.Pid,
+		PPID:     p.PPid,
+		Depth:    p.Depth,
+		Comm:     p.Comm,
+		RSSBytes: p.RSS,
+		CPUSec:   p.CPU.Seconds(),
+		Threads:  p.Threads,
+		FDs:      p.FDs,
+		FDLimit:  p.FDLimit,
+	}
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len(apiPrefix):]
+	if path == "tasks" {
+		if !apiMethod(w, r, "GET") {
+			return
+		}
+		ts := []*apiTask{}
+		for _, t := range GetTasks() {
+			ts = append(ts, newAPITask(t, t.Status(), false))
+		}
+		apiReply(w, http.StatusOK, ts)
+		return
+	}
+	if path == "upgrade" {
+		if !apiMethod(w, r, "POST") {
+			return
+		}
+		bin, err := upgradeBinary()
+		if err != nil {
+			apiErrorf(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		apiReply(w, http.StatusOK, &apiUpgrade{Binary: bin})
+		go func() {
+			// Let the reply go out first.
+			time.Sleep(100 * time.Millisecond)
+			if err := upgrade(); err != nil {
+				logger.Printf("Upgrade failed: %v", err)
+			}
+		}()
+		return
+	}
+	if !strings.HasPrefix(path, "tasks/") {
+		apiErrorf(w, http.StatusNotFound, "unknown API path %q", r.URL.Path)
+		return
+	}
+	name, action := path[len("tasks/"):], ""
+	if i := strings.Index(name, "/"); i != -1 {
+		name, action = name[:i], name[i+1:]
+	}
+	t, ok := GetTask(name)
+	if !ok {
+		apiErrorf(w, http.StatusNotFound, "unknown task %q", name)
+		return
+	}
+
+	var err error
+	switch action {
+	case "":
+		if apiMethod(w, r, "GET") {
+			apiReply(w, http.StatusOK, newAPITask(t, t.Status(), true))
+		}
+		return
+	case "output":
+		if apiMethod(w, r, "GET") {
+			apiTaskOutput(w, r, t)
+		}
+		return
+	case "start":
+		if !apiMethod(w, r, "POST") {
+			return
+		}
+		err = t.Start()
+	case "stop", "restart":
+		if !apiMethod(w, r, "POST") {
+			return
+		}
+		id := r.FormValue("instance")
+		if id == "" {
+			apiErrorf(w, http.StatusBadRequest, "missing instance parameter")
+			return
+		}
+		if action == "stop" {
+			err = t.StopInstance(id)
+		} else {
+			err = t.RestartInstance(id)
+		}
+	default:
+		apiErrorf(w, http.StatusNotFound, "unknown task action %q", action)
+		return
+	}
+	if err != nil {
+		apiErrorf(w, http.StatusConflict, "%v", err)
+		return
+	}
+	apiReply(w, http.StatusOK, newAPITask(t, t.Status(), false))
+}
+
+func apiTaskOutput(w http.ResponseWriter, r *http.Request, t *Task) {
+	since, limit := int64(0), 1000
+	if v := r.FormValue("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			apiErrorf(w, http.StatusBadRequest, "bad since parameter %q", v)
+			return
+		}
+		since = n
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiErrorf(w, http.StatusBadRequest, "bad limit parameter %q", v)
+			return
+		}
+		limit = n
+	}
+
+	st := t.Status()
+	in := st.Running
+	if id := r.FormValue("instance"); id != "" {
+		in = findInstance(st, id)
+		if in == nil {
+			apiErrorf(w, http.StatusNotFound, "task %q has no instance %s", t.Name, id)
+			return
+		}
+	} else if in == nil {
+		apiErrorf(w, http.StatusNotFound, "task %q has no running instance", t.Name)
+		return
+	}
+
+	out := apiOutput{Instance: in.ID(), Lines: []apiLine{}}
+	for _, l := range in.output.linesSince(since, limit) {
+		out.Lines = append(out.Lines, apiLine{
+			Seq:     l.Seq,
+			Time:    l.T,
+			Stream:  l.Name,
+			Data:    l.Data,
+			Partial: l.isPrefix,
+		})
+	}
+	apiReply(w, http.StatusOK, out)
+}
+
+// findInstance returns the instance in st with the given ID, or nil.
+func findInstance(st *TaskStatus, id string) *TaskInstance {
+	all := append([]*TaskInstance{st.Running, st.Previous, st.Stopping}, st.Failures...)
+	for _, in := range all {
+		if in != nil && in.ID() == id {
+			return in
+		}
+	}
+	return nil
+}
+
+// apiMethod reports whether r uses method, replying with an error if not.
+func apiMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	apiErrorf(w, http.StatusMethodNotAllowed, "%s requires %s", r.URL.Path, method)
+	return false
+}
+
+func apiErrorf(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	apiReply(w, code, apiError{fmt.Sprintf(format, args...)})
+}
+
+func apiReply(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logger.Printf("API: encoding %T: %v", v, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
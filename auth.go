@@ -0,0 +1,259 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flags.
+var (
+	tlsCert       = flag.String("tls_cert", "", "If non-empty, PEM certificate file to serve the HTTP admin port with TLS. Reloaded when it changes.")
+	tlsKey        = flag.String("tls_key", "", "PEM private key file for --tls_cert. Reloaded when it changes.")
+	adminAuthFile = flag.String("admin_auth_file", "", "If non-empty, file of \"role user secret\" lines required to use the HTTP admin port. Role is \"reader\" or \"operator\". Callers use HTTP basic auth as user and secret, or bearer token secret.")
+	adminToken    = flag.String("admin_token", os.Getenv("RUNSIT_TOKEN"), "Client commands: bearer token for the HTTP admin port.")
+)
+
+// Roles in an --admin_auth_file.
+const (
+	roleReader   = "reader"
+	roleOperator = "operator"
+)
+
+// authUser is a caller authenticated by an httpAuth.
+type authUser struct {
+	name string
+	role string
+}
+
+type authUserKey struct{}
+
+// httpAuth authenticates callers of the HTTP admin port.
+type httpAuth struct {
+	users   []authEntry
+	secrets map[string]bool // for rejecting duplicate secrets
+}
+
+type authEntry struct {
+	authUser
+	secret string
+}
+
+// loadHTTPAuth reads an --admin_auth_file. Blank lines and lines
+// starting with '#' are ignored.
+func loadHTTPAuth(file string) (*httpAuth, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &httpAuth{secrets: map[string]bool{}}
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs := strings.Fields(line)
+		if len(fs) != 3 {
+			return nil, fmt.Errorf("%s:%d: want \"role user secret\"", file, lineNum)
+		}
+		if fs[0] != roleReader && fs[0] != roleOperator {
+			return nil, fmt.Errorf("%s:%d: unknown role %q; want %q or %q", file, lineNum, fs[0], roleReader, roleOperator)
+		}
+		if a.secrets[fs[2]] {
+			return nil, fmt.Errorf("%s:%d: duplicate secret", file, lineNum)
+		}
+		a.secrets[fs[2]] = true
+		a.users = append(a.users, authEntry{authUser{name: fs[1], role: fs[0]}, fs[2]})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// authenticate returns the caller of r, or nil.
+func (a *httpAuth) authenticate(r *http.Request) *authUser {
+	var user, secret string
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		secret = strings.TrimSpace(h[len("Bearer "):])
+	} else if u, p, ok := r.BasicAuth(); ok {
+		user, secret = u, p
+	} else {
+		return nil
+	}
+	for i := range a.users {
+		e := &a.users[i]
+		if user != "" && user != e.name {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(e.secret)) == 1 {
+			return &e.authUser
+		}
+	}
+	return nil
+}
+
+// handler wraps h, requiring callers to authenticate and allowing
+// only operators to change tasks.
+func (a *httpAuth) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := a.authenticate(r)
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="runsit"`)
+			adminError(w, r, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if isMutating(r) && u.role != roleOperator {
+			logger.Printf("admin: denied %s %s from %s (%s)", r.Method, r.URL, u.name, u.role)
+			adminError(w, r, http.StatusForbidden, fmt.Sprintf("%s may not change tasks", u.name))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, u)))
+	})
+}
+
+// checkMutation wraps h, rejecting requests that change tasks unless
+// they're POSTs not made from some other site's page.
+func checkMutation(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMutating(r) {
+			if r.Method != "POST" {
+				w.Header().Set("Allow", "POST")
+				adminError(w, r, http.StatusMethodNotAllowed, "changing tasks requires POST")
+				return
+			}
+			if o := r.Header.Get("Origin"); o != "" {
+				if u, err := url.Parse(o); err != nil || u.Host != r.Host {
+					adminError(w, r, http.StatusForbidden, "cross-origin request refused")
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func adminError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		apiErrorf(w, code, "%s", msg)
+		return
+	}
+	http.Error(w, msg, code)
+}
+
+// csrfKey is the secret that CSRF tokens are derived from. It's
+// regenerated each time runsit starts.
+var csrfKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// requestIdentity returns a string identifying who made r, as far as
+// the listener it arrived on can tell.
+func requestIdentity(r *http.Request) string {
+	if u, ok := r.Context().Value(authUserKey{}).(*authUser); ok {
+		return "user:" + u.name
+	}
+	if pc, ok := r.Context().Value(peerCredKey{}).(*peerCred); ok {
+		return "uid:" + strconv.Itoa(pc.uid)
+	}
+	return ""
+}
+
+// csrfToken returns the token that forms in pages served for r must
+// include as their "csrf" value.
+func csrfToken(r *http.Request) string {
+	m := hmac.New(sha256.New, csrfKey)
+	m.Write([]byte(requestIdentity(r)))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// validCSRF reports whether r's "csrf" form value is correct.
+func validCSRF(r *http.Request) bool {
+	return hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(csrfToken(r)))
+}
+
+// certReloader serves a TLS certificate from files, reloading it when
+// either file's modification time changes.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If reloading
+// fails, the previously loaded certificate is kept.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cfi, err := os.Stat(cr.certFile)
+	var kfi os.FileInfo
+	if err == nil {
+		kfi, err = os.Stat(cr.keyFile)
+	}
+	if err == nil && (!cfi.ModTime().Equal(cr.certTime) || !kfi.ModTime().Equal(cr.keyTime)) {
+		// Only try each version of the files once.
+		cr.certTime, cr.keyTime = cfi.ModTime(), kfi.ModTime()
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+		if err == nil {
+			if cr.cert != nil {
+				logger.Printf("Reloaded TLS certificate %s", cr.certFile)
+			}
+			cr.cert = &cert
+		}
+	}
+	if err != nil {
+		if cr.cert == nil {
+			return nil, err
+		}
+		logger.Printf("Error reloading TLS certificate; using previous one: %v", err)
+	}
+	return cr.cert, nil
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeAuthFile(t *testing.T, contents string) string {
+	file := filepath.Join(t.TempDir(), "auth")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadHTTPAuth(t *testing.T) {
+	a, err := loadHTTPAuth(writeAuthFile(t, `
+# comment
+reader   alice  s3cret
+  operator bob    hunter2
+
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []authEntry{
+		{authUser{name: "alice", role: roleReader}, "s3cret"},
+		{authUser{name: "bob", role: roleOperator}, "hunter2"},
+	}
+	if len(a.users) != len(want) {
+		t.Fatalf("got %d users; want %d", len(a.users), len(want))
+	}
+	for i, e := range a.users {
+		if e != want[i] {
+			t.Errorf("user %d = %+v; want %+v", i, e, want[i])
+		}
+	}
+
+	for _, bad := range []string{
+		"admin carol x\n",
+		"Reader carol x\n",
+		"reader carol\n",
+		"reader carol x y\n",
+		"reader carol x\noperator dave x\n",
+	} {
+		if _, err := loadHTTPAuth(writeAuthFile(t, bad)); err == nil {
+			t.Errorf("loadHTTPAuth(%q) succeeded; want error", bad)
+		}
+	}
+	if _, err := loadHTTPAuth(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("loadHTTPAuth of missing file succeeded")
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	a, err := loadHTTPAuth(writeAuthFile(t, "reader alice r\noperator bob o\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotUser *authUser
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = r.Context().Value(authUserKey{}).(*authUser)
+	}))
+	tests := []struct {
+		method, path string
+		auth         func(r *http.Request)
+		wantCode     int
+		wantUser     string
+	}{
+		{"GET", "/", nil, http.StatusUnauthorized, ""},
+		{"GET", "/", func(r *http.Request) { r.SetBasicAuth("alice", "r") }, 200, "alice"},
+		{"GET", "/", func(r *http.Request) { r.SetBasicAuth("alice", "o") }, http.StatusUnauthorized, ""},
+		{"GET", "/", func(r *http.Request) { r.SetBasicAuth("bob", "o") }, 200, "bob"},
+		{"GET", "/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer o") }, 200, "bob"},
+		{"GET", "/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized, ""},
+		{"POST", "/task/web?mode=restart", func(r *http.Request) { r.SetBasicAuth("alice", "r") }, http.StatusForbidden, ""},
+		{"GET", "/task/web?mode=kill", func(r *http.Request) { r.SetBasicAuth("alice", "r") }, http.StatusForbidden, ""},
+		{"POST", "/task/web?mode=restart", func(r *http.Request) { r.SetBasicAuth("bob", "o") }, 200, "bob"},
+		{"GET", "/task/web", func(r *http.Request) { r.SetBasicAuth("alice", "r") }, 200, "alice"},
+	}
+	for _, tt := range tests {
+		gotUser = nil
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.auth != nil {
+			tt.auth(r)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		name := ""
+		if gotUser != nil {
+			name = gotUser.name
+		}
+		if w.Code != tt.wantCode || name != tt.wantUser {
+			t.Errorf("%s %s: code %d, user %q; want %d, %q", tt.method, tt.path, w.Code, name, tt.wantCode, tt.wantUser)
+		}
+	}
+}
+
+func TestCheckMutation(t *testing.T) {
+	called := false
+	h := checkMutation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	tests := []struct {
+		method, path, origin string
+		wantCode             int
+	}{
+		{"GET", "/", "", 200},
+		{"GET", "/task/web", "", 200},
+		{"GET", "/task/web?mode=kill", "", http.StatusMethodNotAllowed},
+		{"HEAD", "/task/web?mode=restart", "", http.StatusMethodNotAllowed},
+		{"POST", "/task/web?mode=kill", "", 200},
+		{"POST", "/task/web?mode=kill", "http://example.com", 200},
+		{"POST", "/task/web?mode=kill", "http://evil.com", http.StatusForbidden},
+		{"POST", "/task/web?mode=kill", "null", http.StatusForbidden},
+		{"PUT", "/api/v1/tasks/web/stop", "", http.StatusMethodNotAllowed},
+		{"POST", "/api/v1/tasks/web/stop", "http://evil.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		called = false
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantCode || called != (tt.wantCode == 200) {
+			t.Errorf("%s %s (Origin %q): code %d, called %v; want %d", tt.method, tt.path, tt.origin, w.Code, called, tt.wantCode)
+		}
+	}
+}
+
+func TestValidCSRF(t *testing.T) {
+	withUser := func(r *http.Request, name string) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), authUserKey{}, &authUser{name: name, role: roleOperator}))
+	}
+	page := withUser(httptest.NewRequest("GET", "/task/web", nil), "bob")
+	token := csrfToken(page)
+	if token == csrfToken(withUser(page, "alice")) {
+		t.Fatalf("users share a CSRF token")
+	}
+	post := func(name string, form url.Values) *http.Request {
+		r := httptest.NewRequest("POST", "/task/web", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return withUser(r, name)
+	}
+	tests := []struct {
+		r    *http.Request
+		want bool
+	}{
+		{post("bob", url.Values{"mode": {"kill"}, "csrf": {token}}), true},
+		{post("alice", url.Values{"mode": {"kill"}, "csrf": {token}}), false},
+		{post("bob", url.Values{"mode": {"kill"}}), false},
+		{post("bob", url.Values{"mode": {"kill"}, "csrf": {token[:len(token)-1]}}), false},
+		{withUser(httptest.NewRequest("POST", "/task/web?mode=kill&csrf="+token, nil), "bob"), false}, // not in the body
+	}
+	for i, tt := range tests {
+		if got := validCSRF(tt.r); got != tt.want {
+			t.Errorf("%d. validCSRF = %v; want %v", i, got, tt.want)
+		}
+	}
+}
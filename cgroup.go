@@ -0,0 +1,330 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Cgroups. With --cgroup_root set to a cgroup v2 directory delegated
+// to runsit, each instance runs in its own cgroup under it, named
+// after its task, and these config keys limit it:
+//
+//   "memoryMax": "512M"    memory.max: beyond it, the OOM killer kills
+//                          processes in the cgroup
+//   "memoryHigh": "384M"   memory.high: throttled and reclaimed above it
+//   "cpuWeight": 100       cpu.weight, 1-10000: share of contended CPU
+//   "cpuMax": 1.5          cpu.max, in CPUs
+//   "pidsMax": 512         pids.max: most processes and threads
+//
+// Memory sizes are bytes, or strings with a K, M, G or T suffix.
+//
+// As cgroup v2 only lets a cgroup without processes of its own have
+// limited children, runsit moves itself from the root into a "runsit"
+// cgroup below it, if it was there, and enables the cpu, memory and
+// pids controllers for the instances' cgroups.
+//
+// Stopping an instance signals every process in its cgroup, and once
+// its main process exits, any left are killed. If the OOM killer
+// killed any of its processes, per memory.events, the instance's exit
+// says so.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+var cgroupRoot = flag.String("cgroup_root", "", "If non-empty, a cgroup v2 directory delegated to runsit (e.g. /sys/fs/cgroup/runsit.service) to run each instance in its own cgroup under.")
+
+// cgroupControllers are enabled for instances' cgroups if available.
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+// cgroupEnabled holds the cgroupControllers that are enabled. It's set
+// by initCgroups, before any config is parsed.
+var cgroupEnabled = map[string]bool{}
+
+// cpuMaxPeriod is the cpu.max period, in microseconds.
+const cpuMaxPeriod = 100000
+
+// cgroupLimits are a task's resource limits. Zero values mean no
+// limit.
+type cgroupLimits struct {
+	memoryMax  int64 // bytes
+	memoryHigh int64 // bytes
+	cpuWeight  int
+	cpuMax     float64 // CPUs
+	pidsMax    int
+}
+
+// parseCgroupLimits parses the resource limit keys of a task config.
+func parseCgroupLimits(jc jsonconfig.Obj) (l cgroupLimits, err error) {
+	memMax := jc.OptionalStringOrNumber("memoryMax")
+	memHigh := jc.OptionalStringOrNumber("memoryHigh")
+	l.cpuWeight = jc.OptionalInt("cpuWeight", 0)
+	l.cpuMax = jc.OptionalFloat("cpuMax", 0)
+	l.pidsMax = jc.OptionalInt("pidsMax", 0)
+	if l.memoryMax, err = parseBytes(memMax); err != nil {
+		return l, fmt.Errorf("memoryMax: %v", err)
+	}
+	if l.memoryHigh, err = parseBytes(memHigh); err != nil {
+		return l, fmt.Errorf("memoryHigh: %v", err)
+	}
+	switch {
+	case l.cpuWeight < 0 || l.cpuWeight > 10000:
+		return l, errors.New("cpuWeight must be from 1 to 10000")
+	case l.cpuMax < 0:
+		return l, errors.New("cpuMax must not be negative")
+	case l.cpuMax > 0 && l.cpuMax*cpuMaxPeriod < 1000:
+		return l, errors.New("cpuMax must be at least 0.01")
+	case l.pidsMax < 0:
+		return l, errors.New("pidsMax must not be negative")
+	}
+	if l != (cgroupLimits{}) && *cgroupRoot == "" {
+		return l, errors.New("resource limits require runsit's --cgroup_root")
+	}
+	for _, f := range l.files() {
+		if c := f[0][:strings.Index(f[0], ".")]; !cgroupEnabled[c] {
+			return l, fmt.Errorf("%s requires the %s cgroup controller, which isn't available under --cgroup_root", f[0], c)
+		}
+	}
+	return l, nil
+}
+
+// parseBytes parses a memory size: a number of bytes, or a string
+// with a K, M, G or T suffix. v may be nil, for no size.
+func parseBytes(v interface{}) (int64, error) {
+	var n float64
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		n = v
+	case string:
+		s, shift := strings.ToUpper(v), uint(0)
+		if i := strings.LastIndexAny(s, "KMGT"); i != -1 && i == len(s)-1 {
+			shift = 10 * uint(strings.IndexByte("KMGT", s[i])+1)
+			s = s[:i]
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad size %q", v)
+		}
+		n = f * float64(int64(1)<<shift)
+	default:
+		return 0, fmt.Errorf("bad size %v", v)
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	return int64(n), nil
+}
+
+// files returns the cgroup files to write to apply l, and their
+// values.
+func (l cgroupLimits) files() [][2]string {
+	var fs [][2]string
+	add := func(file string, v int64) {
+		if v > 0 {
+			fs = append(fs, [2]string{file, strconv.FormatInt(v, 10)})
+		}
+	}
+	add("memory.max", l.memoryMax)
+	add("memory.high", l.memoryHigh)
+	add("cpu.weight", int64(l.cpuWeight))
+	add("pids.max", int64(l.pidsMax))
+	if l.cpuMax > 0 {
+		fs = append(fs, [2]string{"cpu.max", fmt.Sprintf("%d %d", int64(l.cpuMax*cpuMaxPeriod), cpuMaxPeriod)})
+	}
+	return fs
+}
+
+// initCgroups prepares --cgroup_root for instances' cgroups.
+func initCgroups() error {
+	root := *cgroupRoot
+	if err := checkCgroup2(root); err != nil {
+		return err
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(root, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, pid := range strings.Fields(string(procs)) {
+		if pid != self {
+			continue
+		}
+		leaf := filepath.Join(root, "runsit")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := writeCgroupFile(leaf, "cgroup.procs", self); err != nil {
+			return fmt.Errorf("moving runsit into %s: %v", leaf, err)
+		}
+		logger.Printf("Moved runsit into cgroup %s", leaf)
+	}
+	avail, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, c := range cgroupControllers {
+		if strings.Contains(" "+string(avail)+" ", " "+c+" ") {
+			enable = append(enable, "+"+c)
+			cgroupEnabled[c] = true
+		} else {
+			logger.Printf("cgroup controller %q isn't available in %s", c, root)
+		}
+	}
+	if len(enable) > 0 {
+		if err := writeCgroupFile(root, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			return fmt.Errorf("enabling controllers: %v", err)
+		}
+	}
+
+	// Remove empty cgroups of instances that exited while runsit
+	// wasn't running. Those of live instances aren't empty, so
+	// can't be removed.
+	dirs, _ := ioutil.ReadDir(root)
+	for _, fi := range dirs {
+		if fi.IsDir() && fi.Name() != "runsit" {
+			syscall.Rmdir(filepath.Join(root, fi.Name()))
+		}
+	}
+	logger.Printf("Running instances in cgroups under %s", root)
+	return nil
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(value))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cgroup is an instance's cgroup.
+type cgroup struct {
+	dir string
+}
+
+// newCgroup creates a cgroup for an instance of task with limits l.
+func newCgroup(task string, l cgroupLimits) (*cgroup, error) {
+	cg := &cgroup{filepath.Join(*cgroupRoot, fmt.Sprintf("%s.%d", task, time.Now().UnixNano()))}
+	if err := os.Mkdir(cg.dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, f := range l.files() {
+		if err := writeCgroupFile(cg.dir, f[0], f[1]); err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("setting %s to %s: %v", f[0], f[1], err)
+		}
+	}
+	return cg, nil
+}
+
+// cgroupDir returns the instance's cgroup directory, or "" if it has
+// none.
+func (in *TaskInstance) cgroupDir() string {
+	if in.cgroup == nil {
+		return ""
+	}
+	return in.cgroup.dir
+}
+
+// pids returns the processes in the cgroup.
+func (cg *cgroup) pids() []int {
+	b, err := ioutil.ReadFile(filepath.Join(cg.dir, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, f := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// signal sends sig to every process in the cgroup. SIGKILL kills the
+// whole cgroup at once, including processes forked meanwhile, if the
+// kernel supports cgroup.kill.
+func (cg *cgroup) signal(sig syscall.Signal) {
+	if sig == syscall.SIGKILL && writeCgroupFile(cg.dir, "cgroup.kill", "1") == nil {
+		return
+	}
+	for _, pid := range cg.pids() {
+		syscall.Kill(pid, sig)
+	}
+}
+
+// killWait is how long killAll waits for SIGKILLed processes to go.
+// It's independent of the task's stop timeout, which is how long a
+// task gets to stop cleanly and may be zero.
+const killWait = 5 * time.Second
+
+// killAll kills every process in the cgroup and waits up to killWait
+// for them to exit, signalling any that fork meanwhile. It returns
+// how many were running.
+func (cg *cgroup) killAll() int {
+	n := len(cg.pids())
+	if n == 0 {
+		return 0
+	}
+	deadline := time.Now().Add(killWait)
+	for {
+		cg.signal(syscall.SIGKILL)
+		time.Sleep(10 * time.Millisecond)
+		if len(cg.pids()) == 0 || time.Now().After(deadline) {
+			return n
+		}
+	}
+}
+
+// oomKills returns how many of the cgroup's processes the OOM killer
+// has killed.
+func (cg *cgroup) oomKills() int {
+	b, err := ioutil.ReadFile(filepath.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == "oom_kill" {
+			n, _ := strconv.Atoi(f[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// remove removes the cgroup, which must have no processes left.
+func (cg *cgroup) remove() {
+	if err := syscall.Rmdir(cg.dir); err != nil && !os.IsNotExist(err) {
+		logger.Printf("Error removing cgroup %s: %v", cg.dir, err)
+	}
+}
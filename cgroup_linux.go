@@ -0,0 +1,36 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Not yet in package syscall.
+const cgroup2SuperMagic = 0x63677270
+
+// checkCgroup2 returns an error unless dir is in a cgroup v2
+// filesystem.
+func checkCgroup2(dir string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if st.Type != cgroup2SuperMagic {
+		return fmt.Errorf("%s isn't in a cgroup v2 filesystem", dir)
+	}
+	return nil
+}
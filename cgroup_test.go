@@ -0,0 +1,62 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		want    int64
+		wantErr bool
+	}{
+		{v: nil, want: 0},
+		{v: 1024.0, want: 1024},
+		{v: "512", want: 512},
+		{v: "1K", want: 1 << 10},
+		{v: "1k", want: 1 << 10},
+		{v: "1.5M", want: 3 << 19},
+		{v: "2g", want: 2 << 30},
+		{v: "1T", want: 1 << 40},
+		{v: "0.5K", want: 512},
+		{v: 1.5, want: 1},
+		{v: "0", wantErr: true},
+		{v: 0.0, wantErr: true},
+		{v: "0.5", wantErr: true},
+		{v: "0K", wantErr: true},
+		{v: "-1", wantErr: true},
+		{v: -1.0, wantErr: true},
+		{v: "", wantErr: true},
+		{v: "M", wantErr: true},
+		{v: "lots", wantErr: true},
+		{v: "1KB", wantErr: true},
+		{v: "1 M", wantErr: true},
+		{v: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBytes(%#v) = %d; want error", tt.v, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseBytes(%#v) = %d, %v; want %d", tt.v, got, err, tt.want)
+		}
+	}
+}
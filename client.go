@@ -0,0 +1,455 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Client subcommands, which talk to a running runsit's JSON API:
+//
+//   runsit [--http_port=N] status [-json] [NAME ...]
+//   runsit [--http_port=N] start [-json] NAME
+//   runsit [--http_port=N] stop [-json] NAME
+//   runsit [--http_port=N] restart [-json] NAME
+//   runsit [--http_port=N] logs [-json] [-f] [-n LINES] NAME
+//   runsit [--http_port=N] upgrade [-json]
+//
+// status exits with exitNotRunning (3) if any task it lists isn't up;
+// see isUp.
+//
+// If --admin_socket is set, it's used instead of the HTTP port.
+// Otherwise --admin_token (or $RUNSIT_TOKEN) is sent as a bearer
+// token, and if --tls_cert is set the port is spoken to with TLS,
+// trusting that certificate.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Client exit codes.
+const (
+	exitOK         = 0
+	exitError      = 1 // couldn't reach runsit, or it returned an error
+	exitUsage      = 2
+	exitNotRunning = 3 // status: some named or listed task isn't up
+	exitNoTask     = 4 // no such task
+	exitDenied     = 5 // caller may not do that
+)
+
+var clientCommands = map[string]func(args []string) int{
+	"status":  cmdStatus,
+	"start":   cmdStart,
+	"stop":    cmdStop,
+	"restart": cmdRestart,
+	"logs":    cmdLogs,
+	"upgrade": cmdUpgrade,
+}
+
+// listenHost returns the host the admin HTTP server listens on.
+func listenHost() string {
+	if a := os.Getenv("RUNSIT_LISTEN"); a != "" {
+		return a
+	}
+	return "localhost"
+}
+
+// runClient runs the client subcommand args[0] and returns the
+// process exit code.
+func runClient(args []string) int {
+	cmd, ok := clientCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "runsit: unknown command %q; want one of status, start, stop, restart, logs, upgrade\n", args[0])
+		return exitUsage
+	}
+	return cmd(args[1:])
+}
+
+// apiClientError is an error from the API, or from talking to it.
+type apiClientError struct {
+	code int // HTTP status code, or 0 if runsit couldn't be reached
+	msg  string
+}
+
+func (e *apiClientError) Error() string { return e.msg }
+
+func (e *apiClientError) exitCode() int {
+	switch e.code {
+	case http.StatusNotFound:
+		return exitNoTask
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return exitDenied
+	}
+	return exitError
+}
+
+func apiURL(path string, params url.Values) string {
+	host := listenHost()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http"
+	if *tlsCert != "" {
+		scheme = "https"
+	}
+	u := &url.URL{
+		Scheme:   scheme,
+		Host:     net.JoinHostPort(host, strconv.Itoa(*httpPort)),
+		Path:     apiPrefix + path,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// apiHTTPClient returns the client to reach runsit's API with.
+func apiHTTPClient() (*http.Client, error) {
+	if *adminSocket != "" {
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", *adminSocket)
+				},
+			},
+		}, nil
+	}
+	if *tlsCert == "" {
+		return http.DefaultClient, nil
+	}
+	pem, err := ioutil.ReadFile(*tlsCert)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", *tlsCert)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}, nil
+}
+
+// apiCall does an API request and decodes its JSON response into v,
+// also returning the response body.
+func apiCall(method, path string, params url.Values, v interface{}) ([]byte, error) {
+	c, err := apiHTTPClient()
+	if err != nil {
+		return nil, &apiClientError{msg: fmt.Sprintf("tls_cert: %v", err)}
+	}
+	var req *http.Request
+	if method == "POST" {
+		req, err = http.NewRequest("POST", apiURL(path, nil), strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("GET", apiURL(path, params), nil)
+	}
+	if err != nil {
+		return nil, &apiClientError{msg: err.Error()}
+	}
+	if *adminToken != "" && *adminSocket == "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, &apiClientError{msg: fmt.Sprintf("contacting runsit: %v", err)}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &apiClientError{msg: fmt.Sprintf("reading runsit response: %v", err)}
+	}
+	if res.StatusCode != http.StatusOK {
+		var ae apiError
+		if json.Unmarshal(body, &ae) != nil || ae.Error == "" {
+			ae.Error = res.Status
+		}
+		return body, &apiClientError{code: res.StatusCode, msg: ae.Error}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return body, &apiClientError{msg: fmt.Sprintf("decoding runsit response: %v", err)}
+	}
+	return body, nil
+}
+
+// clientFail prints err and returns its exit code.
+func clientFail(err error) int {
+	fmt.Fprintf(os.Stderr, "runsit: %v\n", err)
+	if ae, ok := err.(*apiClientError); ok {
+		return ae.exitCode()
+	}
+	return exitError
+}
+
+func clientFlags(name, usage string) (fs *flag.FlagSet, jsonOut *bool) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	jsonOut = fs.Bool("json", false, "Print JSON instead of text.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: runsit %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return
+}
+
+// isUp reports whether a task counts as running for the status
+// command's exit code: starting, running, a oneshot that succeeded,
+// or a scheduled task between runs, including one waiting for its
+// dependencies or backing off to retry a failed run. Any other state
+// (new, stopping, stopped-by-operator, exited, failed, hung,
+// crash-looping, config-error, start-error, or waiting or backing-off
+// for an unscheduled task) gives exitNotRunning.
+func isUp(at *apiTask) bool {
+	switch at.State {
+	case StateStarting.String(), StateRunning.String(), StateSucceeded.String(), StateScheduled.String():
+		return true
+	case StateWaiting.String(), StateBackingOff.String():
+		return at.Schedule != ""
+	}
+	return false
+}
+
+func cmdStatus(args []string) int {
+	fs, jsonOut := clientFlags("status", "[-json] [NAME ...]")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	var tasks []*apiTask
+	if fs.NArg() == 0 {
+		body, err := apiCall("GET", "tasks", nil, &tasks)
+		if err != nil {
+			return clientFail(err)
+		}
+		if *jsonOut {
+			os.Stdout.Write(body)
+		}
+	} else {
+		for _, name := range fs.Args() {
+			at := new(apiTask)
+			if _, err := apiCall("GET", "tasks/"+name, nil, at); err != nil {
+				return clientFail(err)
+			}
+			tasks = append(tasks, at)
+		}
+		if *jsonOut {
+			printJSON(tasks)
+		}
+	}
+	code := exitOK
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*jsonOut {
+		fmt.Fprintf(tw, "NAME\tSTATE\tFOR\tPID\tREASON\n")
+	}
+	for _, at := range tasks {
+		if !isUp(at) {
+			code = exitNotRunning
+		}
+		if *jsonOut {
+			continue
+		}
+		pid := "-"
+		if at.Running != nil {
+			pid = strconv.Itoa(at.Running.PID)
+		}
+		age := time.Now().Sub(at.StateSince) / time.Second * time.Second
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\n", at.Name, at.State, age, pid, at.StateReason)
+	}
+	tw.Flush()
+	return code
+}
+
+func cmdStart(args []string) int {
+	return taskAction("start", args)
+}
+
+func cmdStop(args []string) int {
+	return taskAction("stop", args)
+}
+
+func cmdRestart(args []string) int {
+	return taskAction("restart", args)
+}
+
+func cmdUpgrade(args []string) int {
+	fs, jsonOut := clientFlags("upgrade", "[-json]")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	res := new(apiUpgrade)
+	body, err := apiCall("POST", "upgrade", nil, res)
+	if err != nil {
+		return clientFail(err)
+	}
+	if *jsonOut {
+		os.Stdout.Write(body)
+	} else {
+		fmt.Printf("upgrading to %s\n", res.Binary)
+	}
+	return exitOK
+}
+
+func taskAction(action string, args []string) int {
+	fs, jsonOut := clientFlags(action, "[-json] NAME")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	name := fs.Arg(0)
+
+	at := new(apiTask)
+	if _, err := apiCall("GET", "tasks/"+name, nil, at); err != nil {
+		return clientFail(err)
+	}
+	params := url.Values{}
+	switch {
+	case at.Running != nil:
+		params.Set("instance", at.Running.ID)
+	case action == "restart":
+		action = "start"
+	case action == "stop":
+		if *jsonOut {
+			printJSON(at)
+		} else {
+			fmt.Printf("%s: not running (%s)\n", name, at.State)
+		}
+		return exitOK
+	}
+
+	res := new(apiTask)
+	body, err := apiCall("POST", "tasks/"+name+"/"+action, params, res)
+	if err != nil {
+		return clientFail(err)
+	}
+	if *jsonOut {
+		os.Stdout.Write(body)
+	} else {
+		fmt.Printf("%s: %s\n", name, res.Summary)
+	}
+	return exitOK
+}
+
+func cmdLogs(args []string) int {
+	fs, jsonOut := clientFlags("logs", "[-json] [-f] [-n LINES] NAME")
+	follow := fs.Bool("f", false, "Keep printing new output, following restarts.")
+	n := fs.Int("n", 100, "Number of recent lines to print first.")
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	name := fs.Arg(0)
+
+	at := new(apiTask)
+	if _, err := apiCall("GET", "tasks/"+name, nil, at); err != nil {
+		return clientFail(err)
+	}
+	var instance string
+	var since int64
+	if at.Running != nil {
+		instance = at.Running.ID
+		since = at.Running.Lines - int64(*n)
+	} else if len(at.Failures) > 0 {
+		instance = at.Failures[0].ID
+		since = at.Failures[0].Lines - int64(*n)
+	}
+	if since < 0 {
+		since = 0
+	}
+
+	for {
+		if instance != "" {
+			params := url.Values{
+				"instance": {instance},
+				"since":    {strconv.FormatInt(since, 10)},
+				"limit":    {"1000"},
+			}
+			var out apiOutput
+			_, err := apiCall("GET", "tasks/"+name+"/output", params, &out)
+			if ae, ok := err.(*apiClientError); ok && ae.code == http.StatusNotFound && *follow {
+				// The instance aged out of the task's history.
+				instance = ""
+			} else if err != nil {
+				return clientFail(err)
+			}
+			for _, l := range out.Lines {
+				if *jsonOut {
+					json.NewEncoder(os.Stdout).Encode(l)
+				} else {
+					fmt.Printf("%s %s %s\n", l.Time.Format("2006-01-02 15:04:05.000"), l.Stream, l.Data)
+				}
+				since = l.Seq
+			}
+			if len(out.Lines) == 1000 {
+				continue
+			}
+		}
+		if !*follow {
+			return exitOK
+		}
+		time.Sleep(1 * time.Second)
+
+		// Switch to a new instance once the task restarts, after
+		// reading the rest of the old one's output.
+		if _, err := apiCall("GET", "tasks/"+name, nil, at); err != nil {
+			return clientFail(err)
+		}
+		if at.Running != nil && at.Running.ID != instance && (instance == "" || since >= lastSeq(at, instance)) {
+			instance, since = at.Running.ID, 0
+		}
+	}
+}
+
+// lastSeq returns the number of output lines of the given instance
+// of at, or 0 if it's not known.
+func lastSeq(at *apiTask, id string) int64 {
+	all := append([]*apiInstance{at.Running, at.Previous, at.Stopping}, at.Failures...)
+	for _, ai := range all {
+		if ai != nil && ai.ID == id {
+			return ai.Lines
+		}
+	}
+	return 0
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
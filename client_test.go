@@ -0,0 +1,52 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestIsUp(t *testing.T) {
+	tests := []struct {
+		state    TaskState
+		schedule string
+		want     bool
+	}{
+		{StateStarting, "", true},
+		{StateRunning, "", true},
+		{StateSucceeded, "", true},
+		{StateScheduled, "every 1m0s", true},
+		{StateWaiting, "every 1m0s", true},
+		{StateBackingOff, "every 1m0s", true},
+		{StateRunning, "every 1m0s", true},
+		{StateWaiting, "", false},
+		{StateBackingOff, "", false},
+		{StateFailed, "every 1m0s", false},
+		{StateNew, "", false},
+		{StateStopping, "", false},
+		{StateStopped, "", false},
+		{StateExited, "", false},
+		{StateFailed, "", false},
+		{StateHung, "", false},
+		{StateCrashLooping, "", false},
+		{StateConfigError, "", false},
+		{StateStartError, "", false},
+	}
+	for _, tt := range tests {
+		if got := isUp(&apiTask{State: tt.state.String(), Schedule: tt.schedule}); got != tt.want {
+			t.Errorf("isUp(%v, schedule %q) = %v; want %v", tt.state, tt.schedule, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// taskConfig is a task's parsed and validated config file. Parsing
+// has no side effects, so a taskConfig can be rejected without
+// disturbing the task's running instance.
+type taskConfig struct {
+	jc   jsonconfig.Obj // the config file, as read
+	hash string         // of jc; see adopt.go
+
+	lr        *LaunchRequest // without the RUNSIT_* environment
+	ports     []portConfig   // sorted by name; addresses are for this replica
+	instances int            // replicas to run
+
+	restart     restartPolicy
+	stopSignal  syscall.Signal
+	stopTimeout time.Duration
+	labels      map[string]string // extra metrics labels
+	health      *healthCheck      // or nil
+
+	notify       bool          // wait for READY=1 before considering an instance running
+	readyTimeout time.Duration // with notify, restart instances not ready in time; 0 means never
+	watchdog     time.Duration // restart instances not sending WATCHDOG=1 this often; 0 means never
+
+	requires []string // tasks that must be running before this one starts
+	after    []string // tasks that, if starting, must finish first
+
+	rolling bool // start replacement instances before stopping the running one
+
+	oneshot    bool          // run to completion once, rather than as a daemon; see oneshot.go
+	retries    int           // oneshot: times to retry a failed run
+	maxRuntime time.Duration // oneshot: stop runs taking longer than this; 0 means never
+	schedule   *schedule     // run the oneshot periodically, or nil
+
+	// Hooks; see hooks.go. Each is an argv, or nil.
+	preStart    []string
+	postStart   []string
+	postStop    []string
+	hookTimeout time.Duration
+
+	limits cgroupLimits // see cgroup.go
+}
+
+// portConfig is a named port from a task's "ports" object. A port is
+// either shared by all of the task's replicas or allocated per
+// replica:
+//
+//	"web": 8000                 shared; also "web": "127.0.0.1:8000"
+//	"web": {"port": 8000,       replica i listens on port 8000+i
+//	        "host": "127.0.0.1",
+//	        "perInstance": true}
+//	"web": {"port": 8000,       shared, and opened with SO_REUSEPORT
+//	        "reusePort": true}  even with only one instance
+//
+// Shared ports of tasks with more than one instance are opened with
+// SO_REUSEPORT, so the replicas can each listen on them. Otherwise
+// they aren't, so a port conflict is a listen error rather than
+// another process silently getting some of the connections.
+type portConfig struct {
+	name      string
+	addr      string // for net.Listen
+	shared    bool   // same addr for every replica
+	reusePort bool   // open with SO_REUSEPORT
+}
+
+// parsePort parses the value of the named port in a "ports" object,
+// for the given replica.
+func parsePort(name string, vi interface{}, replica int) (portConfig, error) {
+	switch v := vi.(type) {
+	case float64:
+		return portConfig{name: name, addr: ":" + strconv.Itoa(int(v)), shared: true}, nil
+	case string:
+		return portConfig{name: name, addr: v, shared: true}, nil
+	case map[string]interface{}:
+		jc := jsonconfig.Obj(v)
+		port := jc.RequiredInt("port")
+		host := jc.OptionalString("host", "")
+		perInstance := jc.OptionalBool("perInstance", false)
+		reusePort := jc.OptionalBool("reusePort", false)
+		if err := jc.Validate(); err != nil {
+			return portConfig{}, fmt.Errorf("port %q: %v", name, err)
+		}
+		if perInstance {
+			if port == 0 {
+				return portConfig{}, fmt.Errorf("port %q: perInstance requires a non-zero port", name)
+			}
+			if reusePort {
+				return portConfig{}, fmt.Errorf("port %q: reusePort can't be used with perInstance", name)
+			}
+			port += replica
+		}
+		return portConfig{
+			name:      name,
+			addr:      net.JoinHostPort(host, strconv.Itoa(port)),
+			shared:    !perInstance,
+			reusePort: reusePort,
+		}, nil
+	}
+	return portConfig{}, fmt.Errorf("port %q value must be a string, integer or object", name)
+}
+
+// resolveCommand replaces argv[0], the command of a hook or exec
+// health check, with the path of the executable it'll run. As for the
+// shell, a name without a slash is looked up in the task's $PATH, per
+// env; other relative paths are relative to the task's cwd, dir.
+func resolveCommand(argv []string, dir string, env []string) error {
+	if len(argv) == 0 {
+		return nil
+	}
+	dirAbs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("finding absolute path of dir %q: %v", dir, err)
+	}
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dirAbs, p)
+	}
+	name := argv[0]
+	if strings.Contains(name, "/") {
+		p, err := exec.LookPath(abs(name))
+		if err != nil {
+			return err
+		}
+		argv[0] = p
+		return nil
+	}
+	path := ""
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = kv[len("PATH="):]
+		}
+	}
+	for _, d := range filepath.SplitList(path) {
+		if d == "" {
+			d = "."
+		}
+		if p, err := exec.LookPath(abs(filepath.Join(d, name))); err == nil {
+			argv[0] = p
+			return nil
+		}
+	}
+	return fmt.Errorf("%q not found in the task's $PATH", name)
+}
+
+// parseTaskConfig parses and validates jc, including looking up its
+// user and groups and checking that its binary exists. Per-instance
+// ports are allocated for the given replica.
+func parseTaskConfig(jc jsonconfig.Obj, replica int) (tc *taskConfig, err error) {
+	env := []string{}
+	stdEnv := jc.OptionalBool("standardEnv", true)
+
+	userStr := jc.OptionalString("user", "")
+	groupStr := jc.OptionalString("group", "")
+
+	// TODO: medium-term hack to run on linux/arm which lacks cgo support,
+	// so let users define these, even though user.Lookup will fail.
+	userErrUid := jc.OptionalString("userLookupErrUid", "")
+	userErrGid := jc.OptionalString("userLookupErrGid", "")
+	userErrHome := jc.OptionalString("userLookupErrHome", "")
+
+	// TODO: group? requires http://code.google.com/p/go/issues/detail?id=2617
+	var runas *user.User
+	if userStr != "" {
+		runas, err = user.Lookup(userStr)
+		if err != nil {
+			if userErrUid != "" {
+				runas = &user.User{
+					Uid:      userErrUid,
+					Gid:      userErrGid,
+					Username: userStr,
+					HomeDir:  userErrHome,
+				}
+			} else {
+				return nil, err
+			}
+		}
+		if stdEnv {
+			env = append(env, fmt.Sprintf("USER=%s", userStr))
+			env = append(env, fmt.Sprintf("HOME=%s", runas.HomeDir))
+		}
+	} else {
+		if stdEnv {
+			env = append(env, fmt.Sprintf("USER=%s", os.Getenv("USER")))
+			env = append(env, fmt.Sprintf("HOME=%s", os.Getenv("HOME")))
+		}
+	}
+
+	envMap := jc.OptionalObject("env")
+	envHas := func(k string) bool {
+		_, ok := envMap[k]
+		return ok
+	}
+	for k, v := range envMap {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	if stdEnv && !envHas("PATH") {
+		env = append(env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/bin:/usr/sbin:/sbin:/bin")
+	}
+
+	var ports []portConfig
+	for portName, vi := range jc.OptionalObject("ports") {
+		p, err := parsePort(portName, vi, replica)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+	sort.Sort(byPortName(ports))
+
+	bin := jc.RequiredString("binary")
+	dir := jc.OptionalString("cwd", "")
+	args := jc.OptionalList("args")
+	groups := jc.OptionalList("groups")
+	requires := jc.OptionalList("requires")
+	after := jc.OptionalList("after")
+	numFiles := jc.OptionalInt("numFiles", 0)
+	instances := jc.OptionalInt("instances", 1)
+	stopSigStr := jc.OptionalString("stopSignal", "SIGTERM")
+	stopTimeout := seconds(jc.OptionalFloat("stopTimeoutSec", 10))
+	notify := jc.OptionalBool("notify", false)
+	readyTimeout := seconds(jc.OptionalFloat("readyTimeoutSec", 60))
+	watchdog := seconds(jc.OptionalFloat("watchdogSec", 0))
+	sched, err := parseSchedule(jc.OptionalObject("schedule"))
+	if err != nil {
+		return nil, fmt.Errorf("schedule configuration error: %v", err)
+	}
+	defType, defRetries := "daemon", 3
+	if sched != nil {
+		defType, defRetries = "oneshot", 0
+	}
+	taskType := jc.OptionalString("type", defType)
+	oneshot := taskType == "oneshot"
+	retries := jc.OptionalInt("retries", defRetries)
+	maxRuntime := seconds(jc.OptionalFloat("maxRuntimeSec", 0))
+	rolling := jc.OptionalBool("rollingRestart", len(ports) > 0 && !oneshot)
+	preStart := jc.OptionalList("preStart")
+	postStart := jc.OptionalList("postStart")
+	postStop := jc.OptionalList("postStop")
+	hookTimeout := seconds(jc.OptionalFloat("hookTimeoutSec", 60))
+	restart, err := parseRestartPolicy(jc.OptionalObject("restart"))
+	if err != nil {
+		return nil, fmt.Errorf("restart configuration error: %v", err)
+	}
+	labels := map[string]string{}
+	for k, vi := range jc.OptionalObject("labels") {
+		v, ok := vi.(string)
+		if !ok {
+			return nil, fmt.Errorf("label %q value must be a string", k)
+		}
+		if !validLabelName(k) {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		labels[k] = v
+	}
+	health, err := parseHealthCheck(jc.OptionalObject("healthCheck"), ports, instances)
+	if err != nil {
+		return nil, fmt.Errorf("healthCheck configuration error: %v", err)
+	}
+	limits, err := parseCgroupLimits(jc)
+	if err != nil {
+		return nil, err
+	}
+	if err := jc.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration error: %v", err)
+	}
+	stopSig, ok := signalByName(stopSigStr)
+	if !ok {
+		return nil, fmt.Errorf("unknown stopSignal %q", stopSigStr)
+	}
+	if stopTimeout < 0 {
+		return nil, fmt.Errorf("stopTimeoutSec must not be negative")
+	}
+	for _, d := range append(append([]string(nil), requires...), after...) {
+		if d == "" || strings.ContainsAny(d, "/\\") {
+			return nil, fmt.Errorf("invalid task name %q in requires or after", d)
+		}
+	}
+	if taskType != "daemon" && taskType != "oneshot" {
+		return nil, fmt.Errorf("unknown type %q; want \"daemon\" or \"oneshot\"", taskType)
+	}
+	if retries < 0 || maxRuntime < 0 {
+		return nil, fmt.Errorf("retries and maxRuntimeSec must not be negative")
+	}
+	if sched != nil && !oneshot {
+		return nil, fmt.Errorf("schedule requires type \"oneshot\"")
+	}
+	for _, k := range []string{"retries", "maxRuntimeSec"} {
+		if _, ok := jc[k]; ok && !oneshot {
+			return nil, fmt.Errorf("%s requires type \"oneshot\"", k)
+		}
+	}
+	if oneshot && rolling {
+		return nil, fmt.Errorf("rollingRestart can't be used with oneshot tasks")
+	}
+	if oneshot && len(postStart) > 0 {
+		return nil, fmt.Errorf("postStart can't be used with oneshot tasks")
+	}
+	if instances < 1 {
+		return nil, fmt.Errorf("instances must be at least 1")
+	}
+	for i, p := range ports {
+		if p.shared && instances > 1 {
+			ports[i].reusePort = true
+		}
+	}
+	if readyTimeout < 0 || watchdog < 0 {
+		return nil, fmt.Errorf("readyTimeoutSec and watchdogSec must not be negative")
+	}
+	if hookTimeout <= 0 {
+		return nil, fmt.Errorf("hookTimeoutSec must be positive")
+	}
+
+	finalBin := bin
+	if !filepath.IsAbs(bin) {
+		dirAbs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("finding absolute path of dir %q: %v", dir, err)
+		}
+		finalBin = filepath.Clean(filepath.Join(dirAbs, bin))
+	}
+
+	_, err = os.Stat(finalBin)
+	if err != nil {
+		return nil, fmt.Errorf("stat of binary %q failed: %v", bin, err)
+	}
+
+	for _, cmd := range []struct {
+		key  string
+		argv []string
+	}{{"preStart", preStart}, {"postStart", postStart}, {"postStop", postStop}} {
+		if err := resolveCommand(cmd.argv, dir, env); err != nil {
+			return nil, fmt.Errorf("%s: %v", cmd.key, err)
+		}
+	}
+	if health != nil && health.kind == "exec" {
+		if err := resolveCommand(health.argv, dir, env); err != nil {
+			return nil, fmt.Errorf("healthCheck exec: %v", err)
+		}
+	}
+
+	argv := []string{filepath.Base(bin)}
+	argv = append(argv, args...)
+
+	lr := &LaunchRequest{
+		Path:     bin,
+		Env:      env,
+		Dir:      dir,
+		Argv:     argv,
+		NumFiles: numFiles,
+	}
+
+	if runas != nil {
+		lr.Uid = atoi(runas.Uid)
+		lr.Gid = atoi(runas.Gid)
+	}
+	if groupStr != "" {
+		gid, err := LookupGroupId(groupStr)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up group %q: %v", groupStr, err)
+		}
+		lr.Gid = gid // primary group
+	}
+
+	// supplemental groups:
+	for _, group := range groups {
+		gid, err := LookupGroupId(group)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up group %q: %v", group, err)
+		}
+		lr.Gids = append(lr.Gids, gid)
+	}
+
+	return &taskConfig{
+		jc:          jc,
+		hash:        configHash(jc),
+		lr:          lr,
+		ports:       ports,
+		instances:   instances,
+		restart:     restart,
+		stopSignal:  stopSig,
+		stopTimeout: stopTimeout,
+		labels:      labels,
+		health:      health,
+
+		notify:       notify,
+		readyTimeout: readyTimeout,
+		watchdog:     watchdog,
+
+		requires: requires,
+		after:    after,
+
+		rolling: rolling,
+
+		oneshot:    oneshot,
+		retries:    retries,
+		maxRuntime: maxRuntime,
+		schedule:   sched,
+
+		preStart:    preStart,
+		postStart:   postStart,
+		postStop:    postStop,
+		hookTimeout: hookTimeout,
+
+		limits: limits,
+	}, nil
+}
+
+type byPortName []portConfig
+
+func (s byPortName) Len() int           { return len(s) }
+func (s byPortName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s byPortName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
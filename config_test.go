@@ -0,0 +1,160 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		replica int
+		want    portConfig
+		wantErr bool
+	}{
+		{v: 8000.0, want: portConfig{addr: ":8000", shared: true}},
+		{v: "127.0.0.1:8000", want: portConfig{addr: "127.0.0.1:8000", shared: true}},
+		{v: map[string]interface{}{"port": 8000.0}, want: portConfig{addr: ":8000", shared: true}},
+		{v: map[string]interface{}{"port": 8000.0, "reusePort": true},
+			want: portConfig{addr: ":8000", shared: true, reusePort: true}},
+		{v: map[string]interface{}{"port": 8000.0, "host": "::1", "perInstance": true}, replica: 2,
+			want: portConfig{addr: "[::1]:8002"}},
+		{v: map[string]interface{}{"port": 0.0, "perInstance": true}, wantErr: true},
+		{v: map[string]interface{}{"port": 8000.0, "perInstance": true, "reusePort": true}, wantErr: true},
+		{v: map[string]interface{}{"port": 8000.0, "bogus": 1.0}, wantErr: true},
+		{v: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePort("web", tt.v, tt.replica)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePort(%v) = %+v; want error", tt.v, got)
+			}
+			continue
+		}
+		tt.want.name = "web"
+		if err != nil || got != tt.want {
+			t.Errorf("parsePort(%v, %d) = %+v, %v; want %+v", tt.v, tt.replica, got, err, tt.want)
+		}
+	}
+}
+
+func TestReusePortChanged(t *testing.T) {
+	ports := func(reuse ...bool) *taskConfig {
+		tc := new(taskConfig)
+		for i, r := range reuse {
+			tc.ports = append(tc.ports, portConfig{addr: ":" + string(rune('0'+i)), reusePort: r})
+		}
+		return tc
+	}
+	tests := []struct {
+		old, tc *taskConfig
+		want    bool
+	}{
+		{ports(false), ports(false), false},
+		{ports(true), ports(true), false},
+		{ports(false), ports(true), true},
+		{ports(true, false), ports(true), false},
+		{ports(true), ports(true, false), false},
+		{ports(true, false), ports(true, true), true},
+	}
+	for i, tt := range tests {
+		if got := reusePortChanged(tt.old, tt.tc); got != tt.want {
+			t.Errorf("%d. reusePortChanged = %v; want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{filepath.Join(dir, "local"), 0755},
+		{filepath.Join(bin, "tool"), 0755},
+		{filepath.Join(bin, "data"), 0644},
+	} {
+		if err := ioutil.WriteFile(f.path, []byte("#!/bin/sh\n"), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := []string{"HOME=/nowhere", "PATH=/nonexistent:" + bin}
+	tests := []struct {
+		name    string
+		want    string // or "" for an error
+		withEnv []string
+	}{
+		{"tool", filepath.Join(bin, "tool"), env},
+		{"./local", filepath.Join(dir, "local"), env},
+		{"bin/tool", filepath.Join(bin, "tool"), env},
+		{filepath.Join(bin, "tool"), filepath.Join(bin, "tool"), env},
+		{"local", "", env},     // not in $PATH
+		{"data", "", env},      // not executable
+		{"./missing", "", env}, // no such file
+		{"tool", "", nil},      // no $PATH
+		{"tool", filepath.Join(bin, "tool"), []string{"PATH=bin"}}, // relative to cwd
+	}
+	for _, tt := range tests {
+		argv := []string{tt.name, "arg"}
+		err := resolveCommand(argv, dir, tt.withEnv)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("resolveCommand(%q) = %q; want error", tt.name, argv[0])
+		case tt.want != "" && (err != nil || argv[0] != tt.want):
+			t.Errorf("resolveCommand(%q) = %q, %v; want %q", tt.name, argv[0], err, tt.want)
+		}
+		if argv[1] != "arg" {
+			t.Errorf("resolveCommand(%q) changed args: %q", tt.name, argv)
+		}
+	}
+}
+
+func TestParseTaskConfigOneshotKeys(t *testing.T) {
+	tests := []struct {
+		extra   jsonconfig.Obj
+		wantErr bool
+	}{
+		{jsonconfig.Obj{}, false},
+		{jsonconfig.Obj{"type": "oneshot", "retries": 2.0, "maxRuntimeSec": 60.0}, false},
+		{jsonconfig.Obj{"type": "oneshot", "maxRuntimeSec": 0.0}, false},
+		{jsonconfig.Obj{"retries": 2.0}, true},
+		{jsonconfig.Obj{"maxRuntimeSec": 60.0}, true},
+		{jsonconfig.Obj{"type": "daemon", "maxRuntimeSec": 0.0}, true},
+		{jsonconfig.Obj{"type": "daemon", "retries": 0.0}, true},
+	}
+	for _, tt := range tests {
+		jc := jsonconfig.Obj{"binary": "/bin/true", "cwd": "/"}
+		for k, v := range tt.extra {
+			jc[k] = v
+		}
+		_, err := parseTaskConfig(jc, 0)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTaskConfig(%v) error = %v; want error %v", tt.extra, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression:
+//
+//   minute hour day-of-month month day-of-week
+//
+// Each field is a comma-separated list of *, N or N-M, each optionally
+// followed by /STEP. Months and days of the week may also be given by
+// their three-letter English names, and Sunday is either 0 or 7. As in
+// cron, if both the day of the month and the day of the week are
+// restricted (don't start with *), a day matching either one matches.
+//
+// The shorthands @hourly, @daily (or @midnight), @weekly, @monthly and
+// @yearly (or @annually) are also accepted.
+type cronSchedule struct {
+	expr string
+
+	minute, hour, dom, month, dow uint64 // bit i set if value i matches
+	domStar, dowStar              bool   // field starts with *, as in */2
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var (
+	monthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dowNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+func parseCron(expr string) (*cronSchedule, error) {
+	s := expr
+	if full, ok := cronShorthands[s]; ok {
+		s = full
+	}
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron expression %q has %d fields; want 5", expr, len(f))
+	}
+	c := &cronSchedule{
+		expr:    expr,
+		domStar: strings.HasPrefix(f[2], "*"),
+		dowStar: strings.HasPrefix(f[4], "*"),
+	}
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron minute: %v", err)
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron hour: %v", err)
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron day of month: %v", err)
+	}
+	if c.month, err = parseCronField(f[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("cron month: %v", err)
+	}
+	if c.dow, err = parseCronField(f[4], 0, 7, dowNames); err != nil {
+		return nil, fmt.Errorf("cron day of week: %v", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 << 0 // Sunday
+	}
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression, whose values
+// range from min to max. names, if non-nil, are the names of the
+// values starting at 0.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			a, b := rng, ""
+			if i := strings.Index(rng, "-"); i != -1 {
+				a, b = rng[:i], rng[i+1:]
+			}
+			if lo, err = cronValue(a, min, max, names); err != nil {
+				return 0, err
+			}
+			switch {
+			case b != "":
+				if hi, err = cronValue(b, min, max, names); err != nil {
+					return 0, err
+				}
+			case step == 1:
+				hi = lo
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("empty range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, min, max)
+	}
+	return v, nil
+}
+
+func (c *cronSchedule) String() string { return c.expr }
+
+// next returns the first time after t that matches c, in t's
+// location, or the zero time if there's none within five years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		prev := t
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !t.After(prev) {
+			// time.Date normalized a midnight skipped by a
+			// daylight saving change back to before it.
+			t = prev.Add(time.Hour)
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func bits(vals ...int) uint64 {
+	var b uint64
+	for _, v := range vals {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func bitRange(lo, hi int) uint64 {
+	var b uint64
+	for v := lo; v <= hi; v++ {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		want cronSchedule // expr is ignored
+	}{
+		{"* * * * *", cronSchedule{
+			minute: bitRange(0, 59), hour: bitRange(0, 23), dom: bitRange(1, 31), month: bitRange(1, 12), dow: bitRange(0, 7),
+			domStar: true, dowStar: true,
+		}},
+		{"*/15 0,12 1 * *", cronSchedule{
+			minute: bits(0, 15, 30, 45), hour: bits(0, 12), dom: bits(1), month: bitRange(1, 12), dow: bitRange(0, 7),
+			dowStar: true,
+		}},
+		{"5/20 9-17/4 */10 jan,JUL mon-fri", cronSchedule{
+			minute: bits(5, 25, 45), hour: bits(9, 13, 17), dom: bits(1, 11, 21, 31), month: bits(1, 7), dow: bitRange(1, 5),
+			domStar: true,
+		}},
+		{"0 0 * * 7", cronSchedule{
+			minute: bits(0), hour: bits(0), dom: bitRange(1, 31), month: bitRange(1, 12), dow: bits(0, 7),
+			domStar: true,
+		}},
+		{"0 0 * * sun", cronSchedule{
+			minute: bits(0), hour: bits(0), dom: bitRange(1, 31), month: bitRange(1, 12), dow: bits(0),
+			domStar: true,
+		}},
+		{"@daily", cronSchedule{
+			minute: bits(0), hour: bits(0), dom: bitRange(1, 31), month: bitRange(1, 12), dow: bitRange(0, 7),
+			domStar: true, dowStar: true,
+		}},
+		{"@monthly", cronSchedule{
+			minute: bits(0), hour: bits(0), dom: bits(1), month: bitRange(1, 12), dow: bitRange(0, 7),
+			dowStar: true,
+		}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if c.expr != tt.expr {
+			t.Errorf("parseCron(%q).expr = %q", tt.expr, c.expr)
+		}
+		tt.want.expr = c.expr
+		if *c != tt.want {
+			t.Errorf("parseCron(%q) = %+v; want %+v", tt.expr, *c, tt.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"1,,2 * * * *",
+	} {
+		if c, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) = %+v; want error", expr, *c)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	local := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	thu := utc("2026-01-15 10:07:30") // a Thursday
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time // or zero for never
+	}{
+		{"* * * * *", thu, utc("2026-01-15 10:08:00")},
+		{"*/15 * * * *", thu, utc("2026-01-15 10:15:00")},
+		{"*/15 * * * *", utc("2026-01-15 10:15:00"), utc("2026-01-15 10:30:00")},
+		{"0 * * * *", thu, utc("2026-01-15 11:00:00")},
+		{"30 9 * * *", thu, utc("2026-01-16 09:30:00")},
+		{"0 0 1 * *", thu, utc("2026-02-01 00:00:00")},
+		{"@yearly", thu, utc("2027-01-01 00:00:00")},
+		{"0 0 * * mon", thu, utc("2026-01-19 00:00:00")},
+		{"0 0 * * 7", thu, utc("2026-01-18 00:00:00")},
+		{"59 23 31 12 *", thu, utc("2026-12-31 23:59:00")},
+
+		// Both day fields restricted: either matches.
+		{"0 0 13 * fri", thu, utc("2026-01-16 00:00:00")},
+		// A day field starting with * isn't restricted: both must
+		// match, so odd days of the month that are Mondays.
+		{"0 0 */2 * mon", thu, utc("2026-01-19 00:00:00")},
+		{"0 0 13 * */1", thu, utc("2026-02-13 00:00:00")},
+		{"0 0 13 * */7", thu, utc("2026-09-13 00:00:00")}, // a Sunday
+
+		{"0 0 29 2 *", thu, utc("2028-02-29 00:00:00")},
+		{"0 0 31 2 *", thu, time.Time{}},
+		{"0 0 31 4,6,9,11 *", thu, time.Time{}},
+
+		// 02:30 doesn't exist on 2026-03-08 in New York.
+		{"30 2 * * *", local("2026-03-07 12:00:00"), local("2026-03-09 02:30:00")},
+		{"0 3 * * *", local("2026-03-08 00:00:00"), local("2026-03-08 03:00:00")},
+		// 01:30 happens twice on 2026-11-01; the first is next.
+		{"30 1 * * *", local("2026-11-01 00:00:00"), local("2026-11-01 01:30:00")},
+		{"0 12 * * *", local("2026-11-01 00:00:00"), local("2026-11-01 12:00:00")},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		got := c.next(tt.from)
+		if !got.Equal(tt.want) || got.Location() != tt.from.Location() && !got.IsZero() {
+			t.Errorf("%q.next(%v) = %v; want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNextEvery(t *testing.T) {
+	s := &schedule{every: 90 * time.Second, loc: time.UTC}
+	now := time.Date(2026, 1, 15, 10, 7, 30, 0, time.UTC)
+	if got, want := s.next(now), now.Add(90*time.Second); !got.Equal(want) {
+		t.Errorf("next = %v; want %v", got, want)
+	}
+	s.jitter = 10 * time.Second
+	for i := 0; i < 100; i++ {
+		if got := s.next(now).Sub(now); got < 90*time.Second || got >= 100*time.Second {
+			t.Fatalf("next with jitter is %v after now; want [90s, 100s)", got)
+		}
+	}
+}
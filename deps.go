@@ -0,0 +1,214 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Task dependencies. A task's config may list other tasks by name:
+//
+//   "requires": ["backend"]   don't start until backend is running
+//                             (or, with "notify", ready), or if it's
+//                             a oneshot, has succeeded, or if it's
+//                             scheduled, is between runs
+//   "after": ["logger"]       if logger is known and starting, wait
+//                             until it's running; otherwise don't wait
+//
+// A dependency with "instances" is met only when all of its replicas
+// meet it.
+//
+// Dependencies only order starts; a running task isn't stopped when
+// a dependency stops. On shutdown, tasks are stopped before the tasks
+// they depend on.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	depMu      sync.Mutex
+	taskStates = map[string]TaskState{} // every known task's state
+	taskDeps   = map[string][]string{}  // requires and after of every task with a valid config
+	taskCounts = map[string]int{}       // "instances" of every task with a valid config, by replica 0's name
+	depWaiters = map[string]*Task{}     // tasks in StateWaiting
+)
+
+// depsChangedMessage is sent to a waiting task when the state of a
+// task it depends on changes.
+type depsChangedMessage struct{}
+
+// publishState records that the named task is now in state s, waking
+// any tasks waiting on it.
+func publishState(name string, s TaskState) {
+	depMu.Lock()
+	defer depMu.Unlock()
+	if old, ok := taskStates[name]; ok && old == s {
+		return
+	}
+	taskStates[name] = s
+	wakeWaitersLocked(name)
+}
+
+// forgetTask removes the named, deleted task from the dependency
+// graph.
+func forgetTask(name string) {
+	depMu.Lock()
+	defer depMu.Unlock()
+	delete(taskStates, name)
+	delete(taskDeps, name)
+	delete(taskCounts, name)
+	delete(depWaiters, name)
+	wakeWaitersLocked(name)
+}
+
+// wakeWaitersLocked wakes the waiting tasks that depend on name, or
+// on the task it's a replica of. depMu must be held.
+func wakeWaitersLocked(name string) {
+	base := replicaBase(name)
+	for wname, w := range depWaiters {
+		for _, d := range taskDeps[wname] {
+			if d == base {
+				go func(w *Task) {
+					w.controlc <- depsChangedMessage{}
+				}(w)
+				break
+			}
+		}
+	}
+}
+
+// setTaskDeps records tc's dependencies as the named task's, unless
+// doing so would make a dependency cycle.
+func setTaskDeps(name string, tc *taskConfig) error {
+	deps := append(append([]string(nil), tc.requires...), tc.after...)
+	depMu.Lock()
+	defer depMu.Unlock()
+	for _, d := range deps {
+		if path := depPathLocked(d, name, map[string]bool{}); path != nil {
+			return fmt.Errorf("dependency cycle: %s -> %s", name, strings.Join(path, " -> "))
+		}
+	}
+	taskDeps[name] = deps
+	if replicaBase(name) == name {
+		taskCounts[name] = tc.instances
+	}
+	return nil
+}
+
+// replicasLocked returns the names of the named task's replicas.
+// depMu must be held.
+func replicasLocked(name string) []string {
+	names := []string{name}
+	for i := 1; i < taskCounts[name]; i++ {
+		names = append(names, replicaName(name, i))
+	}
+	return names
+}
+
+// depPathLocked returns a chain of dependencies from from to to,
+// inclusive, or nil if there's none. depMu must be held.
+func depPathLocked(from, to string, seen map[string]bool) []string {
+	if from == to {
+		return []string{to}
+	}
+	if seen[from] {
+		return nil
+	}
+	seen[from] = true
+	for _, d := range taskDeps[from] {
+		if path := depPathLocked(d, to, seen); path != nil {
+			return append([]string{from}, path...)
+		}
+	}
+	return nil
+}
+
+// unmetDeps returns a description of the dependencies keeping the
+// named task with config tc from starting, or "" if it may start. If
+// it may not, the task is woken when those dependencies change.
+func unmetDeps(t *Task, tc *taskConfig) string {
+	depMu.Lock()
+	defer depMu.Unlock()
+	var unmet []string
+	for _, d := range tc.requires {
+		for _, r := range replicasLocked(d) {
+			s, ok := taskStates[r]
+			switch {
+			case !ok:
+				unmet = append(unmet, r+" (requires; unknown task)")
+			case s != StateRunning && s != StateSucceeded && s != StateScheduled:
+				unmet = append(unmet, fmt.Sprintf("%s (requires; %v)", r, s))
+			}
+		}
+	}
+	for _, d := range tc.after {
+		for _, r := range replicasLocked(d) {
+			if s, ok := taskStates[r]; ok && (s == StateNew || s == StateStarting || s == StateWaiting) {
+				unmet = append(unmet, fmt.Sprintf("%s (after; %v)", r, s))
+			}
+		}
+	}
+	if len(unmet) == 0 {
+		delete(depWaiters, t.Name)
+		return ""
+	}
+	depWaiters[t.Name] = t
+	return strings.Join(unmet, ", ")
+}
+
+// run in Task.loop
+func (t *Task) onDepsChanged() {
+	if t.state != StateWaiting || t.running != nil || t.stopping != nil || t.preStarting != nil || t.config == nil || t.operatorStopped {
+		return
+	}
+	t.startInstance(t.config)
+}
+
+// stopAllTasks stops every task, and returns once they've all exited.
+// Each task is stopped only after the tasks depending on it have
+// stopped; otherwise tasks are stopped in parallel.
+func stopAllTasks() {
+	ts := GetTasks()
+	done := make(map[string]chan struct{})
+	for _, t := range ts {
+		done[t.Name] = make(chan struct{})
+	}
+	dependents := make(map[string][]string)
+	depMu.Lock()
+	for name, deps := range taskDeps {
+		if done[name] == nil {
+			continue
+		}
+		for _, d := range deps {
+			dependents[d] = append(dependents[d], name)
+		}
+	}
+	depMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range ts {
+		wg.Add(1)
+		go func(t *Task) {
+			defer wg.Done()
+			defer close(done[t.Name])
+			for _, d := range dependents[t.Name] {
+				<-done[d]
+			}
+			t.Stop()
+		}(t)
+	}
+	wg.Wait()
+}
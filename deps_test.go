@@ -0,0 +1,168 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// resetDeps empties the dependency globals for the duration of a test.
+func resetDeps(t *testing.T) {
+	depMu.Lock()
+	states, deps, counts, waiters := taskStates, taskDeps, taskCounts, depWaiters
+	taskStates = map[string]TaskState{}
+	taskDeps = map[string][]string{}
+	taskCounts = map[string]int{}
+	depWaiters = map[string]*Task{}
+	depMu.Unlock()
+	t.Cleanup(func() {
+		depMu.Lock()
+		taskStates, taskDeps, taskCounts, depWaiters = states, deps, counts, waiters
+		depMu.Unlock()
+	})
+}
+
+func TestSetTaskDeps(t *testing.T) {
+	type dep struct {
+		name            string
+		requires, after []string
+		wantErr         string // or "" for success
+	}
+	tests := []struct {
+		name string
+		deps []dep
+	}{
+		{"self", []dep{
+			{"a", []string{"a"}, nil, "dependency cycle: a -> a"},
+		}},
+		{"self after", []dep{
+			{"a", nil, []string{"a"}, "dependency cycle: a -> a"},
+		}},
+		{"chain", []dep{
+			{"a", []string{"b"}, nil, ""},
+			{"b", []string{"c"}, nil, ""},
+			{"c", nil, nil, ""},
+		}},
+		{"diamond", []dep{
+			{"a", []string{"b", "c"}, nil, ""},
+			{"b", []string{"d"}, nil, ""},
+			{"c", nil, []string{"d"}, ""},
+			{"d", nil, nil, ""},
+		}},
+		{"cycle", []dep{
+			{"a", []string{"b"}, nil, ""},
+			{"b", []string{"c"}, nil, ""},
+			{"c", []string{"a"}, nil, "dependency cycle: c -> a -> b -> c"},
+		}},
+		{"cycle through after", []dep{
+			{"a", nil, []string{"b"}, ""},
+			{"b", []string{"a"}, nil, "dependency cycle: b -> a -> b"},
+		}},
+		{"missing", []dep{
+			{"a", []string{"ghost"}, []string{"phantom"}, ""},
+		}},
+		{"rejected config leaves no edges", []dep{
+			{"a", []string{"b"}, nil, ""},
+			{"b", []string{"a"}, nil, "dependency cycle: b -> a -> b"},
+			{"c", []string{"b"}, nil, ""},
+			{"b", []string{"c"}, nil, "dependency cycle: b -> c -> b"},
+		}},
+	}
+	for _, tt := range tests {
+		resetDeps(t)
+		for _, d := range tt.deps {
+			err := setTaskDeps(d.name, &taskConfig{requires: d.requires, after: d.after})
+			switch {
+			case d.wantErr == "" && err != nil:
+				t.Errorf("%s: setTaskDeps(%q) = %v; want success", tt.name, d.name, err)
+			case d.wantErr != "" && (err == nil || err.Error() != d.wantErr):
+				t.Errorf("%s: setTaskDeps(%q) = %v; want %q", tt.name, d.name, err, d.wantErr)
+			}
+		}
+	}
+}
+
+func TestUnmetDeps(t *testing.T) {
+	resetDeps(t)
+	taskStates["up"] = StateRunning
+	taskStates["done"] = StateSucceeded
+	taskStates["down"] = StateExited
+	taskStates["new"] = StateNew
+	taskStates["starting"] = StateStarting
+	taskCounts["web"] = 3
+	taskStates["web"] = StateRunning
+	taskStates["web@1"] = StateStarting
+	taskCounts["pool"] = 2
+	taskStates["pool"] = StateRunning
+	taskStates["pool@1"] = StateRunning
+
+	task := &Task{Name: "t"}
+	tests := []struct {
+		requires, after []string
+		want            string
+	}{
+		{nil, nil, ""},
+		{[]string{"up", "done"}, nil, ""},
+		{[]string{"ghost"}, nil, "ghost (requires; unknown task)"},
+		{[]string{"down"}, nil, "down (requires; exited)"},
+		{nil, []string{"ghost", "up", "down"}, ""},
+		{nil, []string{"new", "starting"}, "new (after; new), starting (after; starting)"},
+
+		// Every replica counts.
+		{[]string{"pool"}, nil, ""},
+		{[]string{"web"}, nil, "web@1 (requires; starting), web@2 (requires; unknown task)"},
+		{nil, []string{"pool", "web"}, "web@1 (after; starting)"},
+	}
+	for _, tt := range tests {
+		got := unmetDeps(task, &taskConfig{requires: tt.requires, after: tt.after})
+		if got != tt.want {
+			t.Errorf("unmetDeps(requires %q, after %q) = %q; want %q", tt.requires, tt.after, got, tt.want)
+		}
+		if waiting := depWaiters["t"] != nil; waiting != (tt.want != "") {
+			t.Errorf("unmetDeps(requires %q, after %q): waiting = %v", tt.requires, tt.after, waiting)
+		}
+	}
+}
+
+func TestReplicaWakesWaiters(t *testing.T) {
+	resetDeps(t)
+	if err := setTaskDeps("web", &taskConfig{instances: 2}); err != nil {
+		t.Fatal(err)
+	}
+	front := &Task{Name: "front", controlc: make(chan interface{}, 1)}
+	tc := &taskConfig{requires: []string{"web"}}
+	if err := setTaskDeps("front", tc); err != nil {
+		t.Fatal(err)
+	}
+	publishState("web", StateRunning)
+	if got := unmetDeps(front, tc); got != "web@1 (requires; unknown task)" {
+		t.Fatalf("unmetDeps = %q", got)
+	}
+	publishState("web@1", StateRunning)
+	select {
+	case m := <-front.controlc:
+		if _, ok := m.(depsChangedMessage); !ok {
+			t.Fatalf("got %T; want depsChangedMessage", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken by replica's state change")
+	}
+	if got := unmetDeps(front, tc); got != "" {
+		t.Errorf("unmetDeps = %q; want none", got)
+	}
+}
@@ -20,12 +20,17 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/gob"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // LaunchRequest is a subset of exec.Cmd plus the addition of Uid/Gid.
@@ -40,14 +45,32 @@ type LaunchRequest struct {
 	Env      []string
 	Argv     []string // must include Path as argv[0]
 	Dir      string
-	NumFiles int // new nfile fd rlimit, or 0 to not change
+	NumFiles int    // new nfile fd rlimit, or 0 to not change
+	Cgroup   string // cgroup directory to join, or "" to not change
 }
 
-func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, errPipe io.ReadCloser, err error) {
+// command returns the command that runs lr by re-execing runsit as
+// its child process, which sets up the user, limits and directory
+// before execing lr.Path.
+func (lr *LaunchRequest) command(extraFiles []*os.File) (*exec.Cmd, error) {
 	var buf bytes.Buffer
 	b64enc := base64.NewEncoder(base64.StdEncoding, &buf)
-	err = gob.NewEncoder(b64enc).Encode(lr)
+	err := gob.NewEncoder(b64enc).Encode(lr)
 	b64enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(cmd.Env, "_RUNSIT_LAUNCH_INFO="+buf.String())
+	cmd.ExtraFiles = extraFiles
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	return cmd, nil
+}
+
+func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, errPipe io.ReadCloser, err error) {
+	cmd, err = lr.command(extraFiles)
 	if err != nil {
 		return
 	}
@@ -62,13 +85,6 @@ func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, e
 		}
 	}()
 
-	cmd = exec.Command(os.Args[0])
-	cmd.Env = append(cmd.Env, "_RUNSIT_LAUNCH_INFO="+buf.String())
-	cmd.ExtraFiles = extraFiles
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
-	}
-
 	outPipe, err = cmd.StdoutPipe()
 	if err != nil {
 		return
@@ -78,7 +94,7 @@ func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, e
 		return
 	}
 
-	err = cmd.Start()
+	err = startChild(cmd)
 	if err != nil {
 		return
 	}
@@ -86,6 +102,60 @@ func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, e
 	return cmd, outPipe, errPipe, nil
 }
 
+// outputWait is how long run keeps reading a command's output after
+// it exits, in case something it started in the background still has
+// its stdout or stderr open.
+const outputWait = time.Second
+
+// run starts lr and waits for it to exit, killing its process group
+// if it's still running after timeout. It returns up to maxOut bytes
+// of each of its stdout and stderr.
+//
+// Output is read until the command exits, and then for outputWait at
+// most, so a process it leaves running with its output open, such as
+// a daemon it started, doesn't hold it up or make it time out.
+func (lr *LaunchRequest) run(timeout time.Duration, maxOut int64) (out []byte, err error) {
+	cmd, outPipe, errPipe, err := lr.start(nil)
+	if err != nil {
+		return nil, err
+	}
+	read := func(r io.Reader, c chan<- []byte) {
+		b, _ := ioutil.ReadAll(io.LimitReader(r, maxOut))
+		io.Copy(ioutil.Discard, r)
+		c <- b
+	}
+	outc, errc := make(chan []byte, 1), make(chan []byte, 1)
+	go read(outPipe, outc)
+	go read(errPipe, errc)
+
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	// Not cmd.Wait, which would close the pipes before they're read.
+	state, err := cmd.Process.Wait()
+	forgetChild(cmd.Process.Pid)
+	timedOut := !timer.Stop()
+
+	closePipes := time.AfterFunc(outputWait, func() {
+		outPipe.Close()
+		errPipe.Close()
+	})
+	out = append(<-outc, <-errc...)
+	closePipes.Stop()
+	outPipe.Close()
+	errPipe.Close()
+
+	switch {
+	case timedOut:
+		return out, fmt.Errorf("timed out after %v", timeout)
+	case err != nil:
+		return out, err
+	case !state.Success():
+		return out, &exec.ExitError{ProcessState: state}
+	}
+	return out, nil
+}
+
 func MaybeBecomeChildProcess() {
 	lrs := os.Getenv("_RUNSIT_LAUNCH_INFO")
 	if lrs == "" {
@@ -111,6 +181,12 @@ func MaybeBecomeChildProcess() {
 			log.Fatalf("failed to set NOFILE rlimit: %v", err)
 		}
 	}
+	if lr.Cgroup != "" {
+		pid := []byte(strconv.Itoa(os.Getpid()))
+		if err := ioutil.WriteFile(filepath.Join(lr.Cgroup, "cgroup.procs"), pid, 0); err != nil {
+			log.Fatalf("failed to join cgroup %s: %v", lr.Cgroup, err)
+		}
+	}
 	if lr.Gid != 0 {
 		if err := syscall.Setgid(lr.Gid); err != nil {
 			log.Fatalf("failed to Setgid(%d): %v", lr.Gid, err)
@@ -132,6 +208,9 @@ func MaybeBecomeChildProcess() {
 			log.Fatalf("failed to chdir to %q: %v", lr.Dir, err)
 		}
 	}
-	err = syscall.Exec(lr.Path, lr.Argv, lr.Env)
+	// RUNSIT_PID lets runsit find which instance orphaned
+	// descendants belong to; see proctree.go.
+	env := append(lr.Env, fmt.Sprintf("RUNSIT_PID=%d", os.Getpid()))
+	err = syscall.Exec(lr.Path, lr.Argv, env)
 	log.Fatalf("failed to exec %q: %v", lr.Path, err)
 }
@@ -0,0 +1,108 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// exitInfo describes how a finished instance ended.
+type exitInfo struct {
+	Code       int            // exit code, or -1 if killed by a signal or unknown
+	Signal     syscall.Signal // signal that killed it, or 0
+	CoreDumped bool
+	StopReason string // why runsit stopped it, or "" if it ended on its own
+	OOMKills   int    // processes in its cgroup killed by the OOM killer
+	Duration   time.Duration
+
+	// From its rusage; zero if unknown:
+	UserCPU   time.Duration
+	SysCPU    time.Duration
+	MaxRSS    int64 // bytes
+	MajFaults int64
+}
+
+// newExitInfo returns the exitInfo of a process that ran for dur and
+// ended with state ps, which may be nil if Wait failed.
+func newExitInfo(ps *os.ProcessState, dur time.Duration, stopReason string) *exitInfo {
+	e := &exitInfo{Code: -1, StopReason: stopReason, Duration: dur}
+	if ps == nil {
+		return e
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			e.Signal = ws.Signal()
+			e.CoreDumped = ws.CoreDump()
+		} else {
+			e.Code = ws.ExitStatus()
+		}
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		e.UserCPU = time.Duration(ru.Utime.Nano())
+		e.SysCPU = time.Duration(ru.Stime.Nano())
+		e.MaxRSS = int64(ru.Maxrss)
+		if runtime.GOOS != "darwin" {
+			e.MaxRSS *= 1024 // kilobytes elsewhere
+		}
+		e.MajFaults = int64(ru.Majflt)
+	}
+	return e
+}
+
+// status describes how the instance ended, without why, e.g.
+// "killed by SIGSEGV (core dumped)".
+func (e *exitInfo) status() string {
+	switch {
+	case e.Signal != 0:
+		s := "killed by " + signalName(e.Signal)
+		if e.CoreDumped {
+			s += " (core dumped)"
+		}
+		return s
+	case e.Code == 0:
+		return "exited successfully"
+	case e.Code > 0:
+		return fmt.Sprintf("exited with status %d", e.Code)
+	}
+	return "ended for an unknown reason"
+}
+
+// String describes how and, if known, why the instance ended.
+func (e *exitInfo) String() string {
+	s := e.status()
+	switch {
+	case e.StopReason != "":
+		s += " after being stopped: " + e.StopReason
+	case e.OOMKills > 0 && e.Signal == syscall.SIGKILL:
+		s += " by the OOM killer: out of memory"
+	case e.OOMKills > 0:
+		s += fmt.Sprintf(" after the OOM killer killed %d of its processes", e.OOMKills)
+	case e.Signal == syscall.SIGKILL:
+		s += " (not sent by runsit; possibly the OOM killer)"
+	}
+	return s
+}
+
+// Usage summarizes the instance's run time and resource use.
+func (e *exitInfo) Usage() string {
+	return fmt.Sprintf("ran %v; CPU %v user, %v system; max RSS %s; %d major faults",
+		e.Duration, e.UserCPU, e.SysCPU, formatBytes(e.MaxRSS), e.MajFaults)
+}
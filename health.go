@@ -0,0 +1,241 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// healthCheck is a task's parsed "healthCheck" config block. Exactly
+// one of its "http" and "exec" keys is set:
+//
+//   "http": "web"          GET http://<port web>/<path>; 2xx and 3xx are healthy
+//   "exec": ["./check"]    run a command as the task's user, with its env
+//                          and cwd; exit status 0 is healthy
+//
+// There's no plain TCP connect check: runsit holds the listener of
+// every task port (see rolling.go), so the kernel accepts connections
+// to it whatever the instance is doing, and such a check could never
+// fail.
+type healthCheck struct {
+	kind string   // "http" or "exec"
+	addr string   // http: host:port to connect to
+	path string   // http: URL path
+	argv []string // exec
+
+	interval  time.Duration
+	timeout   time.Duration
+	grace     time.Duration // after starting, before the first check
+	threshold int           // consecutive failures before restarting
+}
+
+// parseHealthCheck parses a "healthCheck" block, which may refer to
+// the task's ports. It returns nil if jc is empty.
+//
+// An "http" check of a task with several instances must use a
+// "perInstance" port: the replicas share the connections to a shared
+// port, so another replica would answer the check.
+func parseHealthCheck(jc jsonconfig.Obj, ports []portConfig, instances int) (*healthCheck, error) {
+	if len(jc) == 0 {
+		return nil, nil
+	}
+	hc := &healthCheck{
+		path:      jc.OptionalString("path", "/"),
+		argv:      jc.OptionalList("exec"),
+		interval:  seconds(jc.OptionalFloat("intervalSec", 10)),
+		timeout:   seconds(jc.OptionalFloat("timeoutSec", 5)),
+		grace:     seconds(jc.OptionalFloat("graceSec", 10)),
+		threshold: jc.OptionalInt("failureThreshold", 3),
+	}
+	httpPort := jc.OptionalString("http", "")
+	tcpPort := jc.OptionalString("tcp", "")
+	if err := jc.Validate(); err != nil {
+		return nil, err
+	}
+	if tcpPort != "" {
+		return nil, fmt.Errorf(`"tcp" checks can't fail, as runsit holds port %q's listener and connections to it always succeed; use "http" or "exec"`, tcpPort)
+	}
+
+	var port string
+	n := 0
+	if httpPort != "" {
+		hc.kind, port = "http", httpPort
+		n++
+	}
+	if len(hc.argv) > 0 {
+		hc.kind = "exec"
+		n++
+	}
+	if n != 1 {
+		return nil, errors.New(`exactly one of "http" or "exec" is required`)
+	}
+	if port != "" {
+		addr, err := dialAddr(port, ports, instances)
+		if err != nil {
+			return nil, err
+		}
+		hc.addr = addr
+	}
+	if !strings.HasPrefix(hc.path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", hc.path)
+	}
+	if hc.interval <= 0 || hc.timeout <= 0 || hc.grace < 0 {
+		return nil, errors.New("intervalSec and timeoutSec must be positive, and graceSec not negative")
+	}
+	if hc.threshold < 1 {
+		return nil, errors.New("failureThreshold must be at least 1")
+	}
+	return hc, nil
+}
+
+// dialAddr returns the address to connect to the task's named port,
+// which must be the instance's own.
+func dialAddr(name string, ports []portConfig, instances int) (string, error) {
+	for _, p := range ports {
+		if p.name != name {
+			continue
+		}
+		if p.shared && instances > 1 {
+			return "", fmt.Errorf("port %q is shared by the task's %d instances, so any of them could answer; make it \"perInstance\"", name, instances)
+		}
+		host, port, err := net.SplitHostPort(p.addr)
+		if err != nil {
+			return "", fmt.Errorf("port %q: %v", name, err)
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	return "", fmt.Errorf("no port named %q in ports", name)
+}
+
+func (hc *healthCheck) String() string {
+	switch hc.kind {
+	case "http":
+		return "GET http://" + hc.addr + hc.path
+	}
+	return "exec " + strings.Join(hc.argv, " ")
+}
+
+// check runs the health check once. lr is the task's launch request,
+// for exec checks.
+func (hc *healthCheck) check(lr *LaunchRequest) error {
+	switch hc.kind {
+	case "http":
+		return hc.checkHTTP()
+	}
+	return hc.checkExec(lr)
+}
+
+func (hc *healthCheck) checkHTTP() error {
+	c := &http.Client{
+		Timeout: hc.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := c.Get("http://" + hc.addr + hc.path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("HTTP status %s", res.Status)
+	}
+	return nil
+}
+
+func (hc *healthCheck) checkExec(tlr *LaunchRequest) error {
+	lr := *tlr
+	lr.Path = hc.argv[0]
+	lr.Argv = hc.argv
+	// Keep a little of the output to say why it failed.
+	out, err := lr.run(hc.timeout, 512)
+	if err != nil {
+		if s := strings.TrimSpace(string(out)); s != "" {
+			return fmt.Errorf("%v: %s", err, s)
+		}
+		return err
+	}
+	return nil
+}
+
+// healthResultMessage is the result of one run of an instance's
+// health check.
+type healthResultMessage struct {
+	in  *TaskInstance
+	err error
+}
+
+// checkHealth runs hc against the instance until it exits.
+//
+// run in its own goroutine
+func (in *TaskInstance) checkHealth(hc *healthCheck) {
+	wait := hc.grace
+	for {
+		select {
+		case <-in.done:
+			return
+		case <-time.After(wait):
+		}
+		err := hc.check(in.config.lr)
+		select {
+		case <-in.done:
+			return
+		case in.task.controlc <- healthResultMessage{in, err}:
+		}
+		wait = hc.interval
+	}
+}
+
+// onHealthResult restarts the running instance once its health check
+// has failed too many times in a row.
+//
+// run in Task.loop
+func (t *Task) onHealthResult(m healthResultMessage) {
+	in := t.running
+	if m.in != in {
+		return
+	}
+	hc := in.config.health
+	t.healthChecked = true
+	if m.err == nil {
+		if t.healthFails > 0 {
+			in.Printf("health check passed after %d failures", t.healthFails)
+		}
+		t.healthFails, t.healthErr = 0, nil
+		return
+	}
+	t.healthFails++
+	t.healthErr = m.err
+	in.Printf("health check failed (%d of %d): %v", t.healthFails, hc.threshold, m.err)
+	if t.healthFails < hc.threshold {
+		return
+	}
+	t.stopToRecover(stopUnhealthy, fmt.Sprintf("health check failed %d times; last: %v", t.healthFails, m.err))
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	ports := []portConfig{
+		{name: "web", addr: ":8000", shared: true},
+		{name: "admin", addr: "127.0.0.1:9000", shared: true},
+		{name: "replica", addr: ":8102"},
+	}
+	tests := []struct {
+		jc        jsonconfig.Obj
+		instances int
+		wantKind  string
+		wantAddr  string
+		wantErr   bool
+	}{
+		{jc: nil},
+		{jc: jsonconfig.Obj{"http": "web"}, wantKind: "http", wantAddr: "localhost:8000"},
+		{jc: jsonconfig.Obj{"http": "admin"}, wantKind: "http", wantAddr: "127.0.0.1:9000"},
+		{jc: jsonconfig.Obj{"exec": []interface{}{"true"}}, wantKind: "exec"},
+		{jc: jsonconfig.Obj{"tcp": "web"}, wantErr: true},
+		{jc: jsonconfig.Obj{"http": "nope"}, wantErr: true},
+		{jc: jsonconfig.Obj{"http": "web", "exec": []interface{}{"true"}}, wantErr: true},
+		{jc: jsonconfig.Obj{"intervalSec": 5.0}, wantErr: true},
+		{jc: jsonconfig.Obj{"http": "web", "path": "x"}, wantErr: true},
+		{jc: jsonconfig.Obj{"http": "web", "failureThreshold": 0.0}, wantErr: true},
+
+		// Several instances: only their own ports.
+		{jc: jsonconfig.Obj{"http": "replica"}, instances: 3, wantKind: "http", wantAddr: "localhost:8102"},
+		{jc: jsonconfig.Obj{"http": "web"}, instances: 3, wantErr: true},
+		{jc: jsonconfig.Obj{"exec": []interface{}{"true"}}, instances: 3, wantKind: "exec"},
+	}
+	for i, tt := range tests {
+		if tt.instances == 0 {
+			tt.instances = 1
+		}
+		hc, err := parseHealthCheck(tt.jc, ports, tt.instances)
+		switch {
+		case tt.wantErr:
+			if err == nil {
+				t.Errorf("%d. parseHealthCheck(%v) = %v; want error", i, tt.jc, hc)
+			}
+		case err != nil:
+			t.Errorf("%d. parseHealthCheck(%v): %v", i, tt.jc, err)
+		case tt.wantKind == "":
+			if hc != nil {
+				t.Errorf("%d. parseHealthCheck(%v) = %v; want nil", i, tt.jc, hc)
+			}
+		case hc.kind != tt.wantKind || hc.addr != tt.wantAddr:
+			t.Errorf("%d. parseHealthCheck(%v) = %s %q; want %s %q", i, tt.jc, hc.kind, hc.addr, tt.wantKind, tt.wantAddr)
+		}
+	}
+}
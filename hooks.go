@@ -0,0 +1,138 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Hooks. A config may give commands to run around each instance:
+//
+//   "preStart": ["./mkdirs", "-v"]    before starting an instance
+//   "postStart": ["./warm-cache"]     once an instance is up (or, with
+//                                     "notify", ready)
+//   "postStop": ["./rm-locks"]        after an instance exits
+//   "hookTimeoutSec": 60              kill hooks running longer
+//
+// Hooks run as the task's user and groups, with its environment and
+// in its cwd, like the binary. As in the shell, a command without a
+// slash is looked up in the task's $PATH; other relative paths are
+// relative to cwd. A command that can't be found is a config error.
+//
+// If preStart fails, the instance isn't started and the task shows a
+// start error with the hook's output. A daemon's start is retried,
+// backing off per the "restart" delays. The output of postStart and
+// postStop goes to the instance's output, and their failure is only
+// logged. A new instance isn't started until the previous one's
+// postStop has finished.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxHookOutput is how much of each of a hook's stdout and stderr is
+// kept.
+const maxHookOutput = 16 << 10
+
+// runHook runs argv as one of tc's hooks and returns its output.
+func runHook(tc *taskConfig, argv []string) (string, error) {
+	lr := *tc.lr
+	lr.Path = argv[0]
+	lr.Argv = argv
+	out, err := lr.run(tc.hookTimeout, maxHookOutput)
+	return strings.TrimSpace(string(out)), err
+}
+
+// preStartRun is a run of a task's preStart hook, before starting an
+// instance with config tc.
+type preStartRun struct {
+	tc *taskConfig
+}
+
+// preStartDoneMessage is sent when a preStart hook exits.
+type preStartDoneMessage struct {
+	run *preStartRun
+	out string
+	err error
+}
+
+// runPreStart runs tc's preStart hook, starting an instance with tc
+// once it succeeds. Until then, the task is starting but has no
+// running instance.
+//
+// run in Task.loop
+func (t *Task) runPreStart(tc *taskConfig) {
+	run := &preStartRun{tc}
+	t.preStarting = run
+	t.setState(StateStarting, "running preStart %q", tc.preStart)
+	go func() {
+		out, err := runHook(tc, tc.preStart)
+		t.controlc <- preStartDoneMessage{run, out, err}
+	}()
+}
+
+// run in Task.loop
+func (t *Task) onPreStartDone(m preStartDoneMessage) {
+	if m.run != t.preStarting {
+		// Canceled by a stop or config change.
+		return
+	}
+	t.preStarting = nil
+	tc := m.run.tc
+	if m.err == nil {
+		t.launchInstance(tc)
+		return
+	}
+	msg := fmt.Sprintf("preStart %q failed: %v", tc.preStart, m.err)
+	if m.out != "" {
+		msg += "; output:\n" + m.out
+	}
+	if prev := t.previous; prev != nil && prev.stopTime.IsZero() {
+		t.running, t.previous = prev, nil
+		t.setState(StateRunning, "replacement not started (%s); still running previous instance", msg)
+		return
+	}
+	t.startError("%s", msg)
+	if !tc.oneshot {
+		t.quickFails++
+		restartIn := t.restart.delay(t.quickFails)
+		t.Printf("Retrying in %v", restartIn)
+		t.scheduleRestart(restartIn)
+	}
+}
+
+// runPostHook runs argv, one of the instance's postStart or postStop
+// hooks, adding its output to the instance's.
+//
+// run in its own goroutine
+func (in *TaskInstance) runPostHook(name string, argv []string) {
+	start := time.Now()
+	out, err := runHook(in.config, argv)
+	if out != "" {
+		for _, line := range strings.Split(out, "\n") {
+			in.output.Add(&Line{
+				T:        time.Now(),
+				Name:     "system",
+				Data:     name + ": " + line,
+				instance: in,
+			})
+		}
+	}
+	if err != nil {
+		in.Printf("%s %q failed: %v", name, argv, err)
+		return
+	}
+	in.Printf("%s %q finished after %v", name, argv, time.Now().Sub(start))
+}
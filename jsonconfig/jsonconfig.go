@@ -116,6 +116,20 @@ func (jc Obj) stringOrObject(key string, required bool) interface{} {
 	return ""
 }
 
+func (jc Obj) OptionalStringOrNumber(key string) interface{} {
+	jc.noteKnownKey(key)
+	ei, ok := jc[key]
+	if !ok {
+		return nil
+	}
+	switch ei.(type) {
+	case string, float64:
+		return ei
+	}
+	jc.appendError(fmt.Errorf("Expected config key %q to be a string or number", key))
+	return nil
+}
+
 func (jc Obj) RequiredBool(key string) bool {
 	return jc.bool(key, nil)
 }
@@ -168,6 +182,32 @@ func (jc Obj) int(key string, def *int) int {
 	return int(b)
 }
 
+func (jc Obj) RequiredFloat(key string) float64 {
+	return jc.float(key, nil)
+}
+
+func (jc Obj) OptionalFloat(key string, def float64) float64 {
+	return jc.float(key, &def)
+}
+
+func (jc Obj) float(key string, def *float64) float64 {
+	jc.noteKnownKey(key)
+	ei, ok := jc[key]
+	if !ok {
+		if def != nil {
+			return *def
+		}
+		jc.appendError(fmt.Errorf("Missing required config key %q (number)", key))
+		return 0
+	}
+	f, ok := ei.(float64)
+	if !ok {
+		jc.appendError(fmt.Errorf("Expected config key %q to be a number", key))
+		return 0
+	}
+	return f
+}
+
 func (jc Obj) RequiredList(key string) []string {
 	return jc.requiredList(key, true)
 }
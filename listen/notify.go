@@ -0,0 +1,85 @@
+package listen
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	notifyOnce sync.Once
+	notifyFile *os.File
+	notifyErr  error
+)
+
+// Notify sends state lines such as "READY=1" or "STATUS=loading index"
+// to the runsit instance supervising this process. It does nothing if
+// the process wasn't started by runsit.
+func Notify(state ...string) error {
+	notifyOnce.Do(func() {
+		s := os.Getenv("RUNSIT_NOTIFY_FD")
+		if s == "" {
+			return
+		}
+		fd, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			notifyErr = fmt.Errorf("invalid RUNSIT_NOTIFY_FD %q: %v", s, err)
+			return
+		}
+		notifyFile = os.NewFile(uintptr(fd), "runsit notify")
+	})
+	if notifyErr != nil || notifyFile == nil {
+		return notifyErr
+	}
+	for _, s := range state {
+		if strings.Contains(s, "\n") {
+			return fmt.Errorf("notify state %q contains a newline", s)
+		}
+	}
+	_, err := notifyFile.Write([]byte(strings.Join(state, "\n") + "\n"))
+	return err
+}
+
+// Ready tells runsit that the process is ready to serve.
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Status sets the status text runsit shows for the process.
+// Newlines are replaced by spaces.
+func Status(text string) error {
+	return Notify("STATUS=" + strings.Replace(text, "\n", " ", -1))
+}
+
+// Stopping tells runsit that the process is shutting down on its own.
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Watchdog tells runsit that the process is still alive.
+func Watchdog() error {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns how often runsit requires Watchdog to be
+// called, or 0 if the task has no "watchdogSec". Processes typically
+// call Watchdog about twice that often, from somewhere that can tell
+// they're making progress:
+//
+//	if d := listen.WatchdogInterval(); d > 0 {
+//		for range time.Tick(d / 2) {
+//			if healthy() {
+//				listen.Watchdog()
+//			}
+//		}
+//	}
+func WatchdogInterval() time.Duration {
+	sec, err := strconv.ParseFloat(os.Getenv("RUNSIT_WATCHDOG_SEC"), 64)
+	if err != nil || sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec * float64(time.Second))
+}
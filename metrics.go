@@ -0,0 +1,171 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// /metrics, in the Prometheus text exposition format.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metric is one metric family being written.
+type metric struct {
+	name, typ, help string
+	samples         []metricSample
+}
+
+type metricSample struct {
+	labels string // rendered, including braces; or empty
+	value  float64
+}
+
+func (m *metric) add(labels string, v float64) {
+	m.samples = append(m.samples, metricSample{labels, v})
+}
+
+func (m *metric) writeTo(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.typ)
+	for _, s := range m.samples {
+		fmt.Fprintf(b, "%s%s %g\n", m.name, s.labels, s.value)
+	}
+}
+
+// validLabelName reports whether s may be used as a task label.
+// "task" and "state" are reserved for runsit's own labels.
+func validLabelName(s string) bool {
+	if s == "" || s == "task" || s == "state" || strings.HasPrefix(s, "__") {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// taskLabels renders the labels for a task's samples, plus any extra
+// name/value pairs.
+func taskLabels(name string, labels map[string]string, extra ...string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{task="%s"`, labelEscaper.Replace(name))
+	for _, k := range keys {
+		fmt.Fprintf(&b, `,%s="%s"`, k, labelEscaper.Replace(labels[k]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		fmt.Fprintf(&b, `,%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1]))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		up = &metric{name: "runsit_task_up", typ: "gauge",
+			help: "Whether the task has a running instance."}
+		state = &metric{name: "runsit_task_state", typ: "gauge",
+			help: "The task's state; 1 for the current state, 0 for the others."}
+		restarts = &metric{name: "runsit_task_restarts_total", typ: "counter",
+			help: "Instances started after the task's first."}
+		hangs = &metric{name: "runsit_task_hangs_total", typ: "counter",
+			help: "Instances stopped as hung for missing their watchdog keepalive."}
+		exitCode = &metric{name: "runsit_task_last_exit_code", typ: "gauge",
+			help: "Exit code of the task's last finished instance, or -1 if it was killed by a signal."}
+		exitSignal = &metric{name: "runsit_task_last_exit_signal", typ: "gauge",
+			help: "Signal that killed the task's last finished instance, or 0."}
+		startTime = &metric{name: "runsit_task_start_time_seconds", typ: "gauge",
+			help: "Start time of the task's running instance, in seconds since the epoch."}
+		quickFails = &metric{name: "runsit_task_consecutive_failures", typ: "gauge",
+			help: "Instances in a row that exited before becoming stable."}
+		outLines = &metric{name: "runsit_task_output_lines_total", typ: "counter",
+			help: "Lines of stdout and stderr captured from the task."}
+		outBytes = &metric{name: "runsit_task_output_bytes_total", typ: "counter",
+			help: "Bytes of stdout and stderr captured from the task, excluding newlines."}
+		rss = &metric{name: "runsit_task_resident_memory_bytes", typ: "gauge",
+			help: "Resident memory of the running instance's process tree."}
+		cpu = &metric{name: "runsit_task_cpu_seconds_total", typ: "counter",
+			help: "User and system CPU time of the running instance's process tree; resets when a new instance starts."}
+		fds = &metric{name: "runsit_task_open_fds", typ: "gauge",
+			help: "Open file descriptors of the running instance's process tree."}
+	)
+	for _, t := range GetTasks() {
+		st := t.Status()
+		l := taskLabels(t.Name, st.Labels)
+		if st.Running != nil {
+			up.add(l, 1)
+			startTime.add(l, float64(st.Running.startTime.UnixNano())/1e9)
+			if g := st.Running.Stats(); g != nil {
+				tot := g.Total()
+				rss.add(l, float64(tot.RSS))
+				cpu.add(l, tot.CPU.Seconds())
+				fds.add(l, float64(tot.FDs))
+			}
+		} else {
+			up.add(l, 0)
+		}
+		for _, s := range stateNames {
+			v := 0.0
+			if s == st.State.String() {
+				v = 1
+			}
+			state.add(taskLabels(t.Name, st.Labels, "state", s), v)
+		}
+		restarts.add(l, float64(st.Restarts))
+		hangs.add(l, float64(st.Hangs))
+		if n := len(st.Failures); n > 0 {
+			e := st.Failures[n-1].Exit()
+			exitCode.add(l, float64(e.Code))
+			exitSignal.add(l, float64(e.Signal))
+		}
+		quickFails.add(l, float64(st.QuickFails))
+		outLines.add(l, float64(atomic.LoadInt64(&t.outputLines)))
+		outBytes.add(l, float64(atomic.LoadInt64(&t.outputBytes)))
+	}
+
+	var b bytes.Buffer
+	for _, m := range []*metric{up, state, restarts, hangs, exitCode, exitSignal, startTime, quickFails, outLines, outBytes, rss, cpu, fds} {
+		m.writeTo(&b)
+	}
+	goroutines := &metric{name: "runsit_goroutines", typ: "gauge",
+		help: "Goroutines in the runsit process."}
+	goroutines.add("", float64(runtime.NumGoroutine()))
+	goroutines.writeTo(&b)
+	logSize := &metric{name: "runsit_log_buffer_bytes", typ: "gauge",
+		help: "Bytes held in runsit's own log buffer."}
+	logSize.add("", float64(logBuf.Len()))
+	logSize.writeTo(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
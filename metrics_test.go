@@ -0,0 +1,65 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestValidLabelName(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"env", true},
+		{"Team_2", true},
+		{"_x", true},
+		{"", false},
+		{"task", false},
+		{"state", false},
+		{"__meta", false},
+		{"2x", false},
+		{"a-b", false},
+		{"a.b", false},
+		{"ümlaut", false},
+	}
+	for _, tt := range tests {
+		if got := validLabelName(tt.s); got != tt.want {
+			t.Errorf("validLabelName(%q) = %v; want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestTaskLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		extra  []string
+		want   string
+	}{
+		{"web", nil, nil, `{task="web"}`},
+		{"web", map[string]string{"team": "a", "env": "prod"}, nil,
+			`{task="web",env="prod",team="a"}`},
+		{"web", map[string]string{"env": "prod"}, []string{"state", "running"},
+			`{task="web",env="prod",state="running"}`},
+		{`we"b`, map[string]string{"note": "a\\b\nc"}, nil,
+			`{task="we\"b",note="a\\b\nc"}`},
+	}
+	for _, tt := range tests {
+		if got := taskLabels(tt.name, tt.labels, tt.extra...); got != tt.want {
+			t.Errorf("taskLabels(%q, %v, %q) = %s; want %s", tt.name, tt.labels, tt.extra, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Each instance gets the write end of a pipe, whose FD number is in
+// $RUNSIT_NOTIFY_FD. The instance writes newline-separated KEY=VALUE
+// lines to it (see the listen package's Notify functions):
+//
+//   READY=1      the instance is ready to serve
+//   STATUS=...   free-form status text, shown in the UI
+//   STOPPING=1   the instance is shutting down on its own
+//   WATCHDOG=1   the instance is still alive
+//
+// Tasks with "notify": true are only considered running once they've
+// sent READY=1, rather than after their restart policy's stableSec.
+//
+// Tasks with "watchdogSec" set get it in $RUNSIT_WATCHDOG_SEC, and
+// must send WATCHDOG=1 at least that often, starting from when they're
+// launched. An instance that doesn't is considered hung and restarted,
+// whatever its restart policy.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifyMessage is a KEY=VALUE line an instance wrote to its notify FD.
+type notifyMessage struct {
+	in         *TaskInstance
+	key, value string
+}
+
+// readyTimeoutMessage is sent if an instance of a task with "notify"
+// set hasn't become ready in time.
+type readyTimeoutMessage struct {
+	in *TaskInstance
+}
+
+// watchNotify reads the instance's notify pipe until every process
+// holding its write end has closed it.
+//
+// run in its own goroutine
+func (in *TaskInstance) watchNotify(r *os.File) {
+	defer r.Close()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		select {
+		case in.task.controlc <- notifyMessage{in, line[:i], line[i+1:]}:
+		case <-in.done:
+		}
+	}
+	if err := s.Err(); err != nil {
+		in.Printf("notify FD: %v", err)
+	}
+}
+
+// run in Task.loop
+func (t *Task) onNotify(m notifyMessage) {
+	in := m.in
+	if in != t.running && in != t.stopping {
+		return
+	}
+	switch m.key {
+	case "READY":
+		if m.value != "1" || in.ready {
+			return
+		}
+		in.ready = true
+		in.Printf("ready")
+		if in == t.running && t.state == StateStarting && !in.config.oneshot {
+			t.setState(StateRunning, "ready after %v", time.Now().Sub(in.startTime))
+			t.onInstanceRunning(in)
+		}
+	case "STATUS":
+		const maxStatus = 500
+		if len(m.value) > maxStatus {
+			m.value = m.value[:maxStatus] + "..."
+		}
+		in.statusText = m.value
+	case "STOPPING":
+		if m.value != "1" {
+			return
+		}
+		in.Printf("stopping on its own")
+		if in == t.running {
+			t.setState(StateStopping, "instance reported STOPPING=1")
+		}
+	case "WATCHDOG":
+		if m.value == "1" {
+			in.watchdogTime = time.Now()
+		}
+	default:
+		in.Printf("unknown notify key %q", m.key)
+	}
+}
+
+// watchdogCheckMessage is sent when an instance's watchdog keepalive
+// may be overdue.
+type watchdogCheckMessage struct {
+	in *TaskInstance
+}
+
+// scheduleWatchdogCheck arranges for the instance's keepalive to be
+// checked after d.
+func (in *TaskInstance) scheduleWatchdogCheck(d time.Duration) {
+	time.AfterFunc(d, func() {
+		select {
+		case in.task.controlc <- watchdogCheckMessage{in}:
+		case <-in.done:
+		}
+	})
+}
+
+// run in Task.loop
+func (t *Task) onWatchdogCheck(m watchdogCheckMessage) {
+	in := m.in
+	if in != t.running {
+		return
+	}
+	last := in.watchdogTime
+	if last.IsZero() {
+		last = in.startTime
+	}
+	limit := in.config.watchdog
+	if since := time.Now().Sub(last); since < limit {
+		in.scheduleWatchdogCheck(limit - since)
+		return
+	}
+	t.hangs++
+	reason := fmt.Sprintf("no watchdog keepalive for %v", limit)
+	in.Printf("hung: %s", reason)
+	t.stopToRecover(stopHung, "hung; "+reason)
+}
+
+// run in Task.loop
+func (t *Task) onReadyTimeout(m readyTimeoutMessage) {
+	in := m.in
+	if in != t.running || in.ready {
+		return
+	}
+	t.stopToRecover(stopUnhealthy, "not ready after "+in.config.readyTimeout.String())
+}
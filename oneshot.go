@@ -0,0 +1,87 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Oneshot tasks. A config with "type": "oneshot" is a job, such as a
+// migration, that runs to completion once per config change (or
+// operator restart) instead of being kept running:
+//
+//   "type": "oneshot"
+//   "retries": 3        retry a failed run up to 3 times, backing
+//                       off per the "restart" delays
+//
+// The task stays starting while its instance runs, then becomes
+// succeeded, or failed once its retries are used up. Tasks that
+// "require" a oneshot wait for it to succeed. "maxRuntimeSec" stops
+// (and fails) a run that takes too long. Both it and "retries" are
+// config errors for daemons.
+//
+// Scheduled tasks (see schedule.go) are oneshots that run repeatedly.
+
+import "time"
+
+// onJobFinished decides what happens after a oneshot task's instance
+// exits on its own.
+//
+// run in Task.loop
+func (t *Task) onJobFinished(in *TaskInstance) {
+	retries := in.config.retries
+	if in.waitErr != nil && t.jobRetries < retries {
+		t.jobRetries++
+		retryIn := t.restart.delay(t.jobRetries)
+		t.setState(StateBackingOff, "%v; retry %d of %d in %v", in.exit, t.jobRetries, retries, retryIn)
+		in.Printf("Retrying in %v", retryIn)
+		t.scheduleRestart(retryIn)
+		return
+	}
+	if t.config != nil && t.config.schedule != nil {
+		t.finishRun(in)
+		return
+	}
+	if in.waitErr == nil {
+		t.setState(StateSucceeded, "%v after %v", in.exit.status(), in.exit.Duration)
+	} else {
+		t.setState(StateFailed, "%v; gave up after %d retries", in.exit, t.jobRetries)
+		in.Printf("Not retrying until restarted by an operator or a config change")
+	}
+	t.closeListeners(nil)
+}
+
+// maxRuntimeMessage is sent when an instance of a oneshot task with
+// "maxRuntimeSec" has been running that long.
+type maxRuntimeMessage struct {
+	in *TaskInstance
+}
+
+// run in Task.loop
+func (t *Task) onMaxRuntime(m maxRuntimeMessage) {
+	if m.in != t.running {
+		return
+	}
+	t.stop("still running after maxRuntimeSec " + m.in.config.maxRuntime.String())
+}
+
+// scheduleMaxRuntime arranges for the instance to be stopped if it's
+// still running after d.
+func (in *TaskInstance) scheduleMaxRuntime(d time.Duration) {
+	time.AfterFunc(d, func() {
+		select {
+		case in.task.controlc <- maxRuntimeMessage{in}:
+		case <-in.done:
+		}
+	})
+}
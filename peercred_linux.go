@@ -0,0 +1,78 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// getPeerCred returns the credentials of the process on the other end
+// of c, using SO_PEERCRED.
+func getPeerCred(c *net.UnixConn) (*peerCred, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var uc *syscall.Ucred
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		uc, serr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("SO_PEERCRED: %v", serr)
+	}
+	pc := &peerCred{
+		pid: int(uc.Pid),
+		uid: int(uc.Uid),
+		gid: int(uc.Gid),
+	}
+	pc.groups, _ = procGroups(pc.pid)
+	return pc, nil
+}
+
+// procGroups returns the supplementary groups of process pid.
+func procGroups(pid int) ([]int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var gids []int
+		for _, f := range strings.Fields(line[len("Groups:"):]) {
+			gid, err := strconv.Atoi(f)
+			if err != nil {
+				return nil, err
+			}
+			gids = append(gids, gid)
+		}
+		return gids, nil
+	}
+	return nil, s.Err()
+}
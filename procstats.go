@@ -0,0 +1,159 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// procStatsInterval is how often running instances' process trees
+// are sampled. All trees are sampled together with one pass over
+// /proc, so the cost barely grows with the number of tasks.
+const procStatsInterval = 5 * time.Second
+
+// procStats is a sample of one process's resource use.
+type procStats struct {
+	Pid     int
+	PPid    int
+	Depth   int // in the process tree; 0 for the instance's main process
+	Comm    string
+	RSS     int64         // resident set size, in bytes
+	CPU     time.Duration // user plus system time
+	Threads int
+	FDs     int // open file descriptors
+	FDLimit int // soft RLIMIT_NOFILE, or 0 if unknown
+}
+
+// treeStats is a sample of every process in an instance's process
+// tree (see proctree.go).
+type treeStats struct {
+	Time  time.Time
+	Procs []procStats // in tree order, main process first
+}
+
+// Total returns the tree's summed RSS, CPU, threads and FDs. Its
+// FDLimit is the main process's.
+func (g *treeStats) Total() procStats {
+	var t procStats
+	for i, p := range g.Procs {
+		if i == 0 {
+			t.Pid, t.Comm, t.FDLimit = p.Pid, p.Comm, p.FDLimit
+		}
+		t.RSS += p.RSS
+		t.CPU += p.CPU
+		t.Threads += p.Threads
+		t.FDs += p.FDs
+	}
+	return t
+}
+
+func (g *treeStats) String() string {
+	t := g.Total()
+	s := fmt.Sprintf("RSS %s, CPU %v, %d threads, %d FDs", formatBytes(t.RSS), t.CPU, t.Threads, t.FDs)
+	if n := len(g.Procs); n > 1 {
+		s = fmt.Sprintf("%d processes: %s", n, s)
+	}
+	return s
+}
+
+var procStatsMu sync.Mutex
+
+var (
+	trackedTrees = map[int]uint64{}     // main process's pid -> its start time, guarded by procStatsMu
+	treeSamples  = map[int]*treeStats{} // main process's pid -> last sample, guarded by procStatsMu
+)
+
+// trackProcessTree starts sampling the process tree of the instance
+// whose main process is pid.
+func trackProcessTree(pid int) {
+	start, _, _ := procIdentity(pid)
+	procStatsMu.Lock()
+	defer procStatsMu.Unlock()
+	trackedTrees[pid] = start
+}
+
+// untrackProcessTree stops sampling the process tree of the instance
+// whose main process is pid.
+func untrackProcessTree(pid int) {
+	procStatsMu.Lock()
+	defer procStatsMu.Unlock()
+	delete(trackedTrees, pid)
+	delete(treeSamples, pid)
+}
+
+// processTreeStats returns the last sample of the process tree of the
+// instance whose main process is pid, or nil if it hasn't been
+// sampled (or sampling isn't supported).
+func processTreeStats(pid int) *treeStats {
+	procStatsMu.Lock()
+	defer procStatsMu.Unlock()
+	return treeSamples[pid]
+}
+
+// Stats returns the last sample of the instance's process tree, or
+// nil if it has exited or hasn't been sampled yet.
+func (in *TaskInstance) Stats() *treeStats {
+	if exited, _, _ := in.Exited(); exited {
+		return nil
+	}
+	return processTreeStats(in.Pid())
+}
+
+// sampleProcStats samples tracked process trees forever.
+//
+// run in its own goroutine
+func sampleProcStats() {
+	for {
+		trees := scanTrees()
+		now := time.Now()
+		samples := make(map[int]*treeStats, len(trees))
+		for root, ps := range trees {
+			g := &treeStats{Time: now}
+			for _, p := range ps {
+				readFDStats(&p.procStats)
+				g.Procs = append(g.Procs, p.procStats)
+			}
+			samples[root] = g
+		}
+		procStatsMu.Lock()
+		for root := range trackedTrees {
+			if g, ok := samples[root]; ok {
+				treeSamples[root] = g
+			} else {
+				delete(treeSamples, root)
+			}
+		}
+		procStatsMu.Unlock()
+		time.Sleep(procStatsInterval)
+	}
+}
+
+// formatBytes formats n as a human-readable size.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
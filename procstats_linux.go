@@ -0,0 +1,156 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/PID/stat.
+// It's 100 on every Linux platform Go supports.
+const clockTicks = 100
+
+var pageSize = int64(os.Getpagesize())
+
+// listProcs returns every process, reading only /proc/PID/stat.
+func listProcs() []*procInfo {
+	d, err := os.Open("/proc")
+	if err != nil {
+		return nil
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil
+	}
+	var procs []*procInfo
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		p, err := readProcStat(pid)
+		if err != nil {
+			continue // likely exited since listing /proc
+		}
+		procs = append(procs, p)
+	}
+	return procs
+}
+
+// readProcStat parses /proc/PID/stat, returning the process's stats
+// (without FDs).
+func readProcStat(pid int) (*procInfo, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parens and may itself contain spaces
+	// or parens, so split around the last ')'.
+	lp, rp := bytes.IndexByte(b, '('), bytes.LastIndexByte(b, ')')
+	if lp < 0 || rp < lp {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	f := strings.Fields(string(b[rp+1:]))
+	// f[0] is field 3 (state) in proc(5).
+	const (
+		fState     = 3 - 3
+		fPPid      = 4 - 3
+		fPgrp      = 5 - 3
+		fUtime     = 14 - 3
+		fStime     = 15 - 3
+		fThreads   = 20 - 3
+		fStartTime = 22 - 3
+		fRSS       = 24 - 3
+	)
+	if len(f) <= fRSS {
+		return nil, fmt.Errorf("short /proc/%d/stat", pid)
+	}
+	num := func(i int) int64 {
+		n, _ := strconv.ParseInt(f[i], 10, 64)
+		return n
+	}
+	return &procInfo{
+		procStats: procStats{
+			Pid:     pid,
+			PPid:    int(num(fPPid)),
+			Comm:    string(b[lp+1 : rp]),
+			RSS:     num(fRSS) * pageSize,
+			CPU:     time.Duration(num(fUtime)+num(fStime)) * time.Second / clockTicks,
+			Threads: int(num(fThreads)),
+		},
+		pgid:   int(num(fPgrp)),
+		start:  uint64(num(fStartTime)),
+		zombie: f[fState] == "Z",
+	}, nil
+}
+
+// readFDStats fills in p's FDs and FDLimit.
+func readFDStats(p *procStats) {
+	p.FDs = countFDs(p.Pid)
+	p.FDLimit = fdLimit(p.Pid)
+}
+
+// procEnv returns the value of key in the environment process pid
+// was started with, or "" if it's not set or can't be read.
+func procEnv(pid int, key string) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return ""
+	}
+	prefix := key + "="
+	for _, kv := range strings.Split(string(b), "\x00") {
+		if strings.HasPrefix(kv, prefix) {
+			return kv[len(prefix):]
+		}
+	}
+	return ""
+}
+
+func countFDs(pid int) int {
+	d, err := os.Open(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0
+	}
+	defer d.Close()
+	names, _ := d.Readdirnames(-1)
+	return len(names)
+}
+
+// fdLimit returns the soft limit on open files of process pid, or 0
+// if it's unknown or unlimited.
+func fdLimit(pid int) int {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		f := strings.Fields(line[len("Max open files"):])
+		if len(f) > 0 {
+			n, _ := strconv.Atoi(f[0])
+			return n
+		}
+	}
+	return 0
+}
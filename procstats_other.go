@@ -0,0 +1,29 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package main
+
+// listProcs would list processes from /proc, which this OS lacks, so
+// no stats or process trees are shown.
+func listProcs() []*procInfo {
+	return nil
+}
+
+func readFDStats(p *procStats) {}
+
+func procEnv(pid int, key string) string {
+	return ""
+}
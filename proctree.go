@@ -0,0 +1,257 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Process trees. An instance's processes are its main process, the
+// rest of its process group, and all their descendants, including
+// ones that start their own session or process group. On Linux,
+// runsit is a child subreaper, so descendants orphaned by their parent
+// exiting (as when a daemon double-forks) are reparented to runsit
+// rather than init, and runsit reaps them once they exit.
+//
+// Each scan of /proc records which instance every process belongs to,
+// so orphans stay in their instance's tree. An orphan runsit hadn't
+// seen yet is put in the tree of the instance whose main process is
+// its $RUNSIT_PID, if that's still in its environment.
+//
+// Stopping an instance signals its whole tree, and once its main
+// process exits, any processes left in the tree are killed.
+
+import (
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// procInfo is a process found by listProcs.
+type procInfo struct {
+	procStats
+	pgid   int
+	start  uint64 // in clock ticks since boot
+	zombie bool
+}
+
+type byProcPid []*procInfo
+
+func (s byProcPid) Len() int           { return len(s) }
+func (s byProcPid) Less(i, j int) bool { return s[i].Pid < s[j].Pid }
+func (s byProcPid) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// treeMember is a process seen in the tree of the instance whose main
+// process is root.
+type treeMember struct {
+	root  int
+	start uint64 // of the process, in case its pid is reused
+}
+
+var (
+	scanMu      sync.Mutex                 // held while scanning trees
+	treeMembers = make(map[int]treeMember) // pid -> last seen membership, guarded by scanMu
+)
+
+// scanTrees returns the live processes in every tracked process tree,
+// keyed by the tree's main process's pid, each in tree order.
+func scanTrees() map[int][]*procInfo {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	procStatsMu.Lock()
+	roots := make(map[int]uint64, len(trackedTrees))
+	for pid, start := range trackedTrees {
+		roots[pid] = start
+	}
+	procStatsMu.Unlock()
+	if len(roots) == 0 {
+		return nil
+	}
+
+	procs := listProcs()
+	byPid := make(map[int]*procInfo, len(procs))
+	for _, p := range procs {
+		byPid[p.Pid] = p
+	}
+	self := os.Getpid()
+	owner := make(map[int]int) // pid -> root, or 0 if in no tree
+	var find func(pid, depth int) int
+	find = func(pid, depth int) int {
+		if root, ok := owner[pid]; ok {
+			return root
+		}
+		p, root := byPid[pid], 0
+		m, seen := treeMembers[pid]
+		switch {
+		case p == nil || depth > len(procs):
+			// Exited, or a parent loop from pids reused mid-scan.
+		case hasRoot(roots, pid):
+			root = pid
+		case seen && m.start == p.start && hasRoot(roots, m.root):
+			root = m.root
+		case hasRoot(roots, p.pgid):
+			root = p.pgid
+		case p.PPid == self:
+			root = envRoot(p, roots)
+		case p.PPid > 1:
+			root = find(p.PPid, depth+1)
+		}
+		owner[pid] = root
+		return root
+	}
+
+	trees := make(map[int][]*procInfo)
+	members := make(map[int]treeMember)
+	for _, p := range procs {
+		if root := find(p.Pid, 0); root != 0 && !p.zombie {
+			trees[root] = append(trees[root], p)
+			members[p.Pid] = treeMember{root, p.start}
+		}
+	}
+	treeMembers = members
+	for root, ps := range trees {
+		trees[root] = treeOrder(root, ps)
+	}
+	return trees
+}
+
+func hasRoot(roots map[int]uint64, pid int) bool {
+	_, ok := roots[pid]
+	return ok
+}
+
+// envRoot returns the root of the tree that p, an orphan, belongs to
+// per its $RUNSIT_PID, or 0 if none.
+func envRoot(p *procInfo, roots map[int]uint64) int {
+	root, err := strconv.Atoi(procEnv(p.Pid, "RUNSIT_PID"))
+	if err != nil {
+		return 0
+	}
+	if start, ok := roots[root]; ok && p.start >= start {
+		return root
+	}
+	return 0
+}
+
+// treeOrder returns ps, the processes in root's tree, in depth-first
+// order with their Depths set. Orphans follow the main process's
+// descendants, as if they were its children.
+func treeOrder(root int, ps []*procInfo) []*procInfo {
+	sort.Sort(byProcPid(ps))
+	inTree := make(map[int]bool, len(ps))
+	for _, p := range ps {
+		inTree[p.Pid] = true
+	}
+	var main *procInfo
+	var orphans []*procInfo
+	children := make(map[int][]*procInfo)
+	for _, p := range ps {
+		switch {
+		case p.Pid == root:
+			main = p
+		case inTree[p.PPid]:
+			children[p.PPid] = append(children[p.PPid], p)
+		default:
+			orphans = append(orphans, p)
+		}
+	}
+	ordered := make([]*procInfo, 0, len(ps))
+	var walk func(p *procInfo, depth int)
+	walk = func(p *procInfo, depth int) {
+		p.Depth = depth
+		ordered = append(ordered, p)
+		for _, c := range children[p.Pid] {
+			walk(c, depth+1)
+		}
+	}
+	if main != nil {
+		walk(main, 0)
+	}
+	for _, p := range orphans {
+		walk(p, 1)
+	}
+	return ordered
+}
+
+// signalTree sends sig to every process in the instance's tree outside
+// its process group, which the caller signals itself.
+func (in *TaskInstance) signalTree(sig syscall.Signal) {
+	for _, p := range scanTrees()[in.Pid()] {
+		if p.pgid == in.Pid() {
+			continue
+		}
+		if err := syscall.Kill(p.Pid, sig); err != nil && err != syscall.ESRCH {
+			in.Printf("Kill(%d, %v) error: %v", p.Pid, signalName(sig), err)
+		}
+	}
+}
+
+// killRemaining kills any processes left in the instance's tree once
+// its main process has exited.
+func (in *TaskInstance) killRemaining() {
+	ps := scanTrees()[in.Pid()]
+	if len(ps) == 0 {
+		return
+	}
+	in.Printf("main process exited; killing %d remaining processes", len(ps))
+	syscall.Kill(-in.Pid(), syscall.SIGKILL)
+	for _, p := range ps {
+		syscall.Kill(p.Pid, syscall.SIGKILL)
+	}
+}
+
+var (
+	childMu  sync.Mutex
+	children = make(map[int]bool) // pids of runsit's children waited for by os/exec, guarded by childMu
+
+	reapc = make(chan bool, 1)
+)
+
+// startChild starts cmd, noting that its process is waited for by
+// cmd.Wait, not reapOrphans.
+func startChild(cmd *exec.Cmd) error {
+	childMu.Lock()
+	defer childMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children[cmd.Process.Pid] = true
+	return nil
+}
+
+// addChild notes that pid, runsit's child, is waited for by os/exec.
+func addChild(pid int) {
+	childMu.Lock()
+	defer childMu.Unlock()
+	children[pid] = true
+}
+
+// forgetChild is called once pid, added by startChild or addChild, has
+// been waited for.
+func forgetChild(pid int) {
+	childMu.Lock()
+	defer childMu.Unlock()
+	delete(children, pid)
+}
+
+// requestReap asks for orphans that have exited to be reaped. It's
+// called on SIGCHLD.
+func requestReap() {
+	select {
+	case reapc <- true:
+	default:
+	}
+}
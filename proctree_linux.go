@@ -0,0 +1,53 @@
+// Copyright 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Not yet in package syscall.
+const prSetChildSubreaper = 36
+
+// startReaper makes runsit a child subreaper, reaping orphaned
+// descendants reparented to it as they exit.
+func startReaper() {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		logger.Printf("Can't become a child subreaper: %v; orphaned descendants will go to init", errno)
+		return
+	}
+	go func() {
+		for range reapc {
+			reapOrphans()
+		}
+	}()
+	requestReap()
+}
+
+// reapOrphans reaps runsit's exited children that os/exec isn't
+// waiting for: orphans reparented to runsit, and children that
+// outlived the runsit it was upgraded from.
+func reapOrphans() {
+	childMu.Lock()
+	defer childMu.Unlock()
+	self := os.Getpid()
+	for _, p := range listProcs() {
+		if p.zombie && p.PPid == self && !children[p.Pid] {
+			var ws syscall.WaitStatus
+			syscall.Wait4(p.Pid, &ws, syscall.WNOHANG, nil)
+		}
+	}
+}
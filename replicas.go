@@ -0,0 +1,152 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Replicas. A config with "instances": N runs N copies of the task.
+// Replica 0 is the Task named after the config file, say "web", and
+// replica i > 0 is its own Task named "web@i", so each replica is
+// stopped, restarted and viewed separately.
+//
+// Only replica 0 watches the config file. When it changes, replica 0
+// creates the missing replicas and passes the update to the others,
+// which each parse the file themselves and remove themselves if
+// they're no longer wanted. A change to "instances" alone doesn't
+// restart existing replicas; RUNSIT_INSTANCES is only updated the
+// next time each one starts. The exception is going from one instance
+// to more, or back, which changes whether shared ports are opened
+// with SO_REUSEPORT (see portConfig); replica 0 is then stopped and
+// started again, and new replicas retry listening until it has.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// replicaSep separates a task's name from its replica number.
+const replicaSep = "@"
+
+func replicaName(base string, i int) string {
+	if i == 0 {
+		return base
+	}
+	return base + replicaSep + strconv.Itoa(i)
+}
+
+// replicaBase returns the name of the task the named replica is a
+// replica of.
+func replicaBase(name string) string {
+	if i := strings.Index(name, replicaSep); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// getOrMakeReplica returns or creates replica i of the task named base.
+func getOrMakeReplica(base string, i int, tf TaskFile) *Task {
+	name := replicaName(base, i)
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+	t, ok := tasks[name]
+	if !ok {
+		t = NewTask(name)
+		t.tf = tf
+		t.replica = i
+		tasks[name] = t
+	}
+	return t
+}
+
+// syncReplicas passes tf to replicas 1 through n-1 of t, creating
+// them as needed, and to any other replicas so they remove
+// themselves. t must be replica 0.
+//
+// run in Task.loop
+func (t *Task) syncReplicas(tf TaskFile, n int) {
+	killSurplusOrphans(t.Name, n)
+	for _, rt := range GetTasks() {
+		if strings.HasPrefix(rt.Name, t.Name+replicaSep) && rt.replica >= n {
+			go rt.Update(tf)
+		}
+	}
+	for i := 1; i < n; i++ {
+		go getOrMakeReplica(t.Name, i, tf).Update(tf)
+	}
+}
+
+// listenPort opens p and returns a copy of the listener's file, to
+// pass to an instance.
+func listenPort(p portConfig) (*os.File, error) {
+	var lc net.ListenConfig
+	if p.reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("setting SO_REUSEPORT: %v", serr)
+			}
+			return nil
+		}
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	return ln.(*net.TCPListener).File()
+}
+
+// reusesPort reports whether lf, a listener from listenPort, was
+// opened with SO_REUSEPORT.
+func reusesPort(lf *os.File) bool {
+	rc, err := lf.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort)
+	})
+	return err == nil && v != 0
+}
+
+// reusePortChanged reports whether changing a task's config from old
+// to tc changes whether any of its ports is opened with SO_REUSEPORT,
+// as when "instances" goes from 1 to more. The running instance's
+// listener would then keep the new one from being opened, so it has
+// to be stopped first.
+func reusePortChanged(old, tc *taskConfig) bool {
+	reuse := make(map[string]bool)
+	for _, p := range old.ports {
+		reuse[p.addr] = p.reusePort
+	}
+	for _, p := range tc.ports {
+		if r, ok := reuse[p.addr]; ok && r != p.reusePort {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// Restart modes.
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// restartPolicy is a task's "restart" config block. It controls
+// whether a task is restarted after its instance exits, and how long
+// to wait before doing so.
+//
+// The delay starts at InitialDelay and is multiplied by Multiplier
+// for each consecutive instance that exited within StableTime of
+// starting, up to MaxDelay. An instance that stays up for at least
+// StableTime resets the delay back to InitialDelay.
+//
+// If MaxRestarts is non-zero, a task that would be restarted more
+// than MaxRestarts times within Window is moved to StateFailed instead.
+type restartPolicy struct {
+	Mode         string // restartAlways, restartOnFailure, or restartNever
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64 // fraction of the delay to randomly add or remove, [0,1]
+	StableTime   time.Duration
+	MaxRestarts  int // or 0 for no limit
+	Window       time.Duration
+}
+
+var defaultRestartPolicy = restartPolicy{
+	Mode:         restartAlways,
+	InitialDelay: 1 * time.Second,
+	MaxDelay:     1 * time.Minute,
+	Multiplier:   2,
+	Jitter:       0.1,
+	StableTime:   5 * time.Second,
+	Window:       5 * time.Minute,
+}
+
+// parseRestartPolicy parses the optional "restart" object of a task
+// config. An empty object yields defaultRestartPolicy.
+func parseRestartPolicy(jc jsonconfig.Obj) (restartPolicy, error) {
+	def := defaultRestartPolicy
+	p := restartPolicy{
+		Mode:         jc.OptionalString("policy", def.Mode),
+		InitialDelay: seconds(jc.OptionalFloat("initialDelaySec", def.InitialDelay.Seconds())),
+		MaxDelay:     seconds(jc.OptionalFloat("maxDelaySec", def.MaxDelay.Seconds())),
+		Multiplier:   jc.OptionalFloat("multiplier", def.Multiplier),
+		Jitter:       jc.OptionalFloat("jitter", def.Jitter),
+		StableTime:   seconds(jc.OptionalFloat("stableSec", def.StableTime.Seconds())),
+		MaxRestarts:  jc.OptionalInt("maxRestarts", def.MaxRestarts),
+		Window:       seconds(jc.OptionalFloat("windowSec", def.Window.Seconds())),
+	}
+	if err := jc.Validate(); err != nil {
+		return p, err
+	}
+	switch p.Mode {
+	case restartAlways, restartOnFailure, restartNever:
+	default:
+		return p, fmt.Errorf("unknown restart policy %q; want %q, %q or %q",
+			p.Mode, restartAlways, restartOnFailure, restartNever)
+	}
+	if p.InitialDelay < 0 || p.MaxDelay < 0 || p.StableTime < 0 || p.Window < 0 {
+		return p, fmt.Errorf("restart delays must not be negative")
+	}
+	if p.MaxDelay < p.InitialDelay {
+		return p, fmt.Errorf("restart maxDelaySec (%v) is less than initialDelaySec (%v)", p.MaxDelay, p.InitialDelay)
+	}
+	if p.Multiplier < 1 {
+		return p, fmt.Errorf("restart multiplier must be at least 1; got %v", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return p, fmt.Errorf("restart jitter must be between 0 and 1; got %v", p.Jitter)
+	}
+	if p.MaxRestarts < 0 {
+		return p, fmt.Errorf("restart maxRestarts must not be negative; got %d", p.MaxRestarts)
+	}
+	return p, nil
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second))
+}
+
+// shouldRestart reports whether an instance that finished with
+// waitErr should be restarted.
+func (p *restartPolicy) shouldRestart(waitErr error) bool {
+	switch p.Mode {
+	case restartNever:
+		return false
+	case restartOnFailure:
+		return waitErr != nil
+	}
+	return true
+}
+
+// delay returns how long to wait before the next restart, given the
+// number of consecutive instances that exited before StableTime.
+func (p *restartPolicy) delay(quickFails int) time.Duration {
+	d := float64(p.InitialDelay)
+	if quickFails > 1 {
+		d *= math.Pow(p.Multiplier, float64(quickFails-1))
+	}
+	if max := float64(p.MaxDelay); d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// noteRestart records a restart at now and reports whether the
+// policy's MaxRestarts within Window has been exceeded.
+// restarts holds the times of previous restarts, oldest first.
+func (p *restartPolicy) noteRestart(restarts []time.Time, now time.Time) (_ []time.Time, exceeded bool) {
+	if p.MaxRestarts == 0 {
+		return nil, false
+	}
+	for len(restarts) > 0 && now.Sub(restarts[0]) > p.Window {
+		restarts = restarts[1:]
+	}
+	if len(restarts) >= p.MaxRestarts {
+		return restarts, true
+	}
+	return append(restarts, now), false
+}
+
+// stopKind says why an instance was stopped, which decides what
+// happens once it exits.
+type stopKind string
+
+const (
+	// stopRequested is any stop not listed below, such as by an
+	// operator, a config change or a oneshot's maxRuntimeSec. It's
+	// the zero stopKind.
+	stopRequested stopKind = ""
+
+	// stopUnhealthy is runsit stopping an instance that failed its
+	// health check or wasn't ready in time.
+	stopUnhealthy stopKind = "unhealthy"
+
+	// stopHung is runsit stopping an instance that missed its
+	// watchdog keepalive.
+	stopHung stopKind = "hung"
+)
+
+// stopToRecover stops the running instance, for a kind other than
+// stopRequested. Once it exits, a daemon is restarted whatever its
+// restart policy, without counting as a crash.
+//
+// run in Task.loop
+func (t *Task) stopToRecover(kind stopKind, reason string) {
+	if in := t.running; in != nil {
+		in.stopKind = kind
+		t.stop(reason)
+	}
+}
+
+// restartRecovered restarts a daemon whose instance in was stopped by
+// stopToRecover. It doesn't count towards quickFails or MaxRestarts.
+//
+// run in Task.loop
+func (t *Task) restartRecovered(in *TaskInstance) {
+	restartIn := t.restart.delay(1)
+	t.setState(StateBackingOff, "%v; restarting in %v", in.exit, restartIn)
+	in.Printf("Restarting in %v", restartIn)
+	t.scheduleRestart(restartIn)
+}
+
+// run in Task.loop
+func (t *Task) scheduleRestart(d time.Duration) {
+	t.cancelRestart()
+	gen := t.restartGen
+	t.restartTime = time.Now().Add(d)
+	t.restartTimer = time.AfterFunc(d, func() {
+		t.controlc <- restartIfStoppedMessage{gen}
+	})
+}
+
+// cancelRestart cancels any pending restart. Its timer may already
+// have fired, so bumping restartGen makes its message stale.
+//
+// run in Task.loop
+func (t *Task) cancelRestart() {
+	if t.restartTimer != nil {
+		t.restartTimer.Stop()
+		t.restartTimer = nil
+	}
+	t.restartTime = time.Time{}
+	t.restartGen++
+}
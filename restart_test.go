@@ -0,0 +1,98 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartDelay(t *testing.T) {
+	p := restartPolicy{
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   2,
+	}
+	tests := []struct {
+		quickFails int
+		want       time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 1 * time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.quickFails); got != tt.want {
+			t.Errorf("delay(%d) = %v; want %v", tt.quickFails, got, tt.want)
+		}
+	}
+}
+
+func TestRestartDelayJitter(t *testing.T) {
+	p := restartPolicy{
+		InitialDelay: 10 * time.Second,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.5,
+	}
+	for i := 0; i < 100; i++ {
+		if d := p.delay(3); d < 5*time.Second || d > 15*time.Second {
+			t.Fatalf("delay(3) = %v; want within [5s, 15s]", d)
+		}
+	}
+}
+
+func TestNoteRestart(t *testing.T) {
+	p := restartPolicy{MaxRestarts: 2, Window: time.Minute}
+	t0 := time.Unix(1e9, 0)
+	var restarts []time.Time
+	steps := []struct {
+		at       time.Duration // since t0
+		exceeded bool
+		n        int // restarts held afterwards
+	}{
+		{0, false, 1},
+		{10 * time.Second, false, 2},
+		{20 * time.Second, true, 2},
+		{61 * time.Second, false, 2}, // first restart aged out
+		{65 * time.Second, true, 2},
+		{3 * time.Minute, false, 1}, // all aged out
+	}
+	for i, st := range steps {
+		var exceeded bool
+		restarts, exceeded = p.noteRestart(restarts, t0.Add(st.at))
+		if exceeded != st.exceeded || len(restarts) != st.n {
+			t.Errorf("step %d (at %v): exceeded = %v with %d restarts; want %v with %d",
+				i, st.at, exceeded, len(restarts), st.exceeded, st.n)
+		}
+	}
+}
+
+func TestNoteRestartUnlimited(t *testing.T) {
+	p := restartPolicy{Window: time.Minute}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		restarts, exceeded := p.noteRestart(nil, now)
+		if exceeded || restarts != nil {
+			t.Fatalf("noteRestart with no MaxRestarts = %v, %v; want nil, false", restarts, exceeded)
+		}
+	}
+}
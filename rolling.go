@@ -0,0 +1,139 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Rolling restarts. runsit keeps its own copy of each task's port
+// listeners open for as long as the task is wanted, and passes the
+// same sockets to every instance, so connections queue rather than
+// being refused while instances come and go.
+//
+// With "rollingRestart" (the default for tasks with ports), a restart
+// or config change starts the new instance alongside the running one,
+// which keeps serving until the new one is up (or, with "notify",
+// ready) and is only then stopped. If the new instance exits or is
+// stopped before it's up, the previous one carries on.
+
+import (
+	"os"
+)
+
+// canRoll reports whether the running instance can be replaced by one
+// with config tc without stopping it first.
+//
+// run in Task.loop
+func (t *Task) canRoll(tc *taskConfig) bool {
+	return tc.rolling && t.running != nil && t.previous == nil && t.stopping == nil
+}
+
+// rollInstance starts an instance with tc to replace the running
+// one, which is stopped once the new instance is up. If the new one
+// can't be started, the running one is kept.
+//
+// run in Task.loop
+func (t *Task) rollInstance(tc *taskConfig, reason string) error {
+	old, oldState := t.running, t.state
+	t.running = nil
+	t.previous = old
+	err := t.startInstance(tc)
+	if t.preStarting != nil {
+		old.Printf("%s; stopping once the replacement is up", reason)
+		return nil
+	}
+	if t.running == nil {
+		t.running, t.previous = old, nil
+		t.setState(oldState, "%s; replacement not started (%s); still running previous instance", reason, t.stateReason)
+		return err
+	}
+	old.Printf("%s; stopping once %s is up", reason, t.running.ID())
+	return nil
+}
+
+// stopPrevious asks the instance being replaced by a rolling restart
+// to exit, if it hasn't been already.
+//
+// run in Task.loop
+func (t *Task) stopPrevious(reason string) {
+	if in := t.previous; in != nil && in.stopTime.IsZero() {
+		in.requestStop(reason)
+	}
+}
+
+// stopAll is like stop, but also stops the instance being replaced by
+// a rolling restart, if any. The returned channel is closed once both
+// are gone.
+//
+// run in Task.loop
+func (t *Task) stopAll(reason string) <-chan struct{} {
+	prev := t.previous
+	done := t.stop(reason)
+	if prev == nil {
+		return done
+	}
+	t.stopPrevious(reason)
+	both := make(chan struct{})
+	go func() {
+		<-done
+		<-prev.done
+		close(both)
+	}()
+	return both
+}
+
+// listener returns runsit's copy of the listener for port p, opening
+// it if it isn't already held.
+//
+// run in Task.loop
+func (t *Task) listener(p portConfig) (*os.File, error) {
+	if lf, ok := t.listeners[p.addr]; ok {
+		if reusesPort(lf) == p.reusePort {
+			return lf, nil
+		}
+		t.Printf("reopening listener on %v to change SO_REUSEPORT", p.addr)
+		lf.Close()
+		delete(t.listeners, p.addr)
+	}
+	lf, err := listenPort(p)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("opened port named %q on %v; fd=%d", p.name, p.addr, lf.Fd())
+	if t.listeners == nil {
+		t.listeners = make(map[string]*os.File)
+	}
+	t.listeners[p.addr] = lf
+	return lf, nil
+}
+
+// closeListeners closes the held listeners that tc doesn't use, or
+// all of them if tc is nil. Instances keep their own copies.
+//
+// run in Task.loop
+func (t *Task) closeListeners(tc *taskConfig) {
+	keep := map[string]bool{}
+	if tc != nil {
+		for _, p := range tc.ports {
+			keep[p.addr] = true
+		}
+	}
+	for addr, lf := range t.listeners {
+		if !keep[addr] {
+			t.Printf("closing listener on %v", addr)
+			lf.Close()
+			delete(t.listeners, addr)
+		}
+	}
+}
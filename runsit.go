@@ -22,6 +22,7 @@ package main
 import (
 	"bufio"
 	"container/list"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
@@ -30,12 +31,12 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
-	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -79,6 +80,16 @@ func (b *logBuffer) Write(p []byte) (ntot int, err error) {
 	return
 }
 
+// Len returns the number of bytes of log held.
+func (b *logBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.full {
+		return len(b.buf)
+	}
+	return b.i
+}
+
 func (b *logBuffer) String() string {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -99,31 +110,92 @@ func (b *logBuffer) String() string {
 // task is deleted, and then the *Task is removed from the global tasks
 // map and a new one could appear later with the same name)
 type Task struct {
+	// Output captured from all instances, accessed atomically.
+	// (first in the struct for 64-bit alignment)
+	outputLines int64
+	outputBytes int64
+
 	// Immutable:
 	Name     string
 	tf       TaskFile
+	replica  int // index among its config's "instances"; see replicas.go
 	controlc chan interface{}
 
 	// State owned by loop's goroutine:
-	config    jsonconfig.Obj // last valid config
-	configErr error          // configuration error
-	errTime   time.Time      // of last configErr
-	running   *TaskInstance
-	failures  []*TaskInstance // last few failures, oldest first.
+	state       TaskState
+	stateTime   time.Time   // when state was entered
+	stateReason string      // why state was entered
+	config      *taskConfig // last valid config
+	configErr   error       // configuration error
+	startErr    error       // error starting the last instance, if it failed
+	running     *TaskInstance
+	previous    *TaskInstance       // instance being replaced by running in a rolling restart, or nil
+	stopping    *TaskInstance       // instance asked to stop that hasn't exited yet, or nil
+	failures    []*TaskInstance     // last few failures, oldest first.
+	listeners   map[string]*os.File // port addr -> runsit's copy of its listener; see rolling.go
+
+	preStarting     *preStartRun // preStart hook to finish before starting an instance, or nil; see hooks.go
+	startPending    bool         // start config once stopping has exited
+	operatorStopped bool         // stopped by Stop; don't restart until Restart
+
+	// Set when an updated config file was rejected and the
+	// previous config (and its instance, if any) was kept:
+	rejectErr  error
+	rejectTime time.Time
+
+	restart      restartPolicy // from last valid config
+	quickFails   int           // consecutive instances that exited before restart.StableTime
+	jobRetries   int           // oneshot: failed runs retried since the config changed or an operator restart
+	runQueued    bool          // scheduled: start a run once the current one exits
+	restartTime  time.Time     // when the pending restart is due, or zero
+	restartTimer *time.Timer   // pending restart, or nil
+	restartGen   int           // bumped whenever the pending restart is replaced or canceled
+	runTime      time.Time     // scheduled: when the next run is due, or zero; see schedule.go
+	runTimer     *time.Timer   // scheduled: next run, or nil
+	runGen       int           // bumped whenever the next run is replaced or canceled
+	restarts     []time.Time   // recent automatic restarts, oldest first; see restart.MaxRestarts
+
+	history []TaskEvent // last keepHistory state changes, oldest first
+	starts  int         // instances ever started
+	hangs   int         // instances stopped as hung for missing their watchdog keepalive
+
+	// Health check results for the running instance:
+	healthChecked bool  // checked at least once
+	healthFails   int   // consecutive failures
+	healthErr     error // last failure, if healthFails > 0
 }
 
 // TaskInstance is a particular instance of a running (or now dead) Task.
 type TaskInstance struct {
-	task      *Task          // set once; not goroutine safe (may only call public methods)
-	startTime time.Time      // set once; immutable
-	config    jsonconfig.Obj // set once; immutable
-	lr        *LaunchRequest // set once; immutable (actual command parameters)
-	cmd       *exec.Cmd      // set once; immutable (command parameters to helper process)
-	output    TaskOutput     // internal locking, safe for concurrent access
+	task      *Task           // set once; not goroutine safe (may only call public methods)
+	startTime time.Time       // set once; immutable
+	config    *taskConfig     // set once; immutable
+	lr        *LaunchRequest  // set once; immutable (actual command parameters)
+	cmd       *exec.Cmd       // set once; immutable (command parameters to helper process)
+	io        *instanceIO     // set once; immutable (runsit's ends of its output and notify FDs)
+	adopted   *instanceRecord // set once; immutable (non-nil if started by a previous runsit; see adopt.go)
+	cgroup    *cgroup         // set once; immutable (nil unless --cgroup_root is set; see cgroup.go)
+	output    TaskOutput      // internal locking, safe for concurrent access
+
+	stopSignal  syscall.Signal // set once; immutable
+	stopTimeout time.Duration  // set once; immutable (before escalating to SIGKILL)
+
+	stopTime time.Time     // set (in requestStop) when asked to stop
+	stopKind stopKind      // set (in stopToRecover) when runsit stops it to recover; owned by Task.loop
+	done     chan struct{} // closed (in awaitDeath) after endTime, waitErr and exit are set
+
+	mu         sync.Mutex
+	stopReason string // guarded by mu; set (in requestStop) when asked to stop
+
+	// Owned by Task.loop; from the instance's notify FD:
+	ready        bool
+	statusText   string
+	watchdogTime time.Time // last WATCHDOG=1
 
 	// Set (in awaitDeath) when task finishes running:
 	endTime time.Time
 	waitErr error // typically nil or *exec.ExitError
+	exit    *exitInfo
 }
 
 // ID returns a unique ID string for this task instance.
@@ -158,11 +230,14 @@ func (in *TaskInstance) Output() []*Line {
 type TaskOutput struct {
 	mu    sync.Mutex
 	lines list.List // of *Line
+	n     int64     // lines ever added
 }
 
 func (to *TaskOutput) Add(l *Line) {
 	to.mu.Lock()
 	defer to.mu.Unlock()
+	to.n++
+	l.Seq = to.n
 	to.lines.PushBack(l)
 	const maxKeepLines = 5000
 	if to.lines.Len() > maxKeepLines {
@@ -180,11 +255,34 @@ func (to *TaskOutput) lineSlice() []*Line {
 	return lines
 }
 
+// count returns the Seq of the most recently added line.
+func (to *TaskOutput) count() int64 {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	return to.n
+}
+
+// linesSince returns up to limit lines with a Seq greater than since,
+// oldest first.
+func (to *TaskOutput) linesSince(since int64, limit int) []*Line {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	var lines []*Line
+	for e := to.lines.Front(); e != nil && len(lines) < limit; e = e.Next() {
+		if l := e.Value.(*Line); l.Seq > since {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
 func NewTask(name string) *Task {
 	t := &Task{
-		Name:     name,
-		controlc: make(chan interface{}),
+		Name:      name,
+		controlc:  make(chan interface{}),
+		stateTime: time.Now(),
 	}
+	publishState(name, t.state)
 	go t.loop()
 	return t
 }
@@ -203,12 +301,55 @@ func (t *Task) loop() {
 		case updateMessage:
 			t.update(m.tf)
 		case stopMessage:
-			err := t.stop()
-			m.resc <- err
+			if err := t.checkInstance(m.id); err != nil {
+				m.resc <- err
+				break
+			}
+			done := t.operatorStop()
+			go func() {
+				<-done
+				m.resc <- nil
+			}()
+		case restartMessage:
+			if err := t.checkInstance(m.id); err != nil {
+				m.resc <- err
+				break
+			}
+			m.resc <- t.restartNow()
+		case startMessage:
+			m.resc <- t.startNow()
+		case instanceUpMessage:
+			if m.in == t.running && t.state == StateStarting && !m.in.config.notify && !m.in.config.oneshot {
+				t.setState(StateRunning, "up for %v", t.restart.StableTime)
+				t.onInstanceRunning(m.in)
+			}
 		case instanceGoneMessage:
 			t.onTaskFinished(m)
 		case restartIfStoppedMessage:
-			t.restartIfStopped()
+			if m.gen == t.restartGen {
+				t.restartIfStopped()
+			}
+		case runDueMessage:
+			if m.gen == t.runGen {
+				t.onRunDue()
+			}
+		case healthResultMessage:
+			t.onHealthResult(m)
+		case notifyMessage:
+			t.onNotify(m)
+		case readyTimeoutMessage:
+			t.onReadyTimeout(m)
+		case watchdogCheckMessage:
+			t.onWatchdogCheck(m)
+		case depsChangedMessage:
+			t.onDepsChanged()
+		case maxRuntimeMessage:
+			t.onMaxRuntime(m)
+		case preStartDoneMessage:
+			t.onPreStartDone(m)
+		case handoverMessage:
+			m.resc <- t.handover(m.pass)
+			<-m.resume
 		}
 	}
 }
@@ -218,6 +359,7 @@ type Line struct {
 	T    time.Time
 	Name string // "stdout", "stderr", or "system"
 	Data string // line or prefix of line
+	Seq  int64  // position in its TaskInstance's output, starting at 1
 
 	isPrefix bool // truncated line? (too long)
 	instance *TaskInstance
@@ -227,11 +369,33 @@ type updateMessage struct {
 	tf TaskFile
 }
 
+// stopMessage and restartMessage act on the running instance. If id
+// is non-empty, they fail unless the running instance has that ID.
 type stopMessage struct {
+	id   string
 	resc chan error
 }
 
-type restartIfStoppedMessage struct{}
+type restartMessage struct {
+	id   string
+	resc chan error
+}
+
+type startMessage struct {
+	resc chan error
+}
+
+// restartIfStoppedMessage is sent by the pending restart's timer. It's
+// stale, and ignored, unless gen is still the task's restartGen.
+type restartIfStoppedMessage struct {
+	gen int
+}
+
+// instanceUpMessage is sent once an instance has been running for its
+// restart policy's StableTime.
+type instanceUpMessage struct {
+	in *TaskInstance
+}
 
 // instanceGoneMessage is sent when a task instance's process finishes,
 // successfully or otherwise. Any error is in instance.waitErr.
@@ -249,12 +413,29 @@ func (t *Task) Update(tf TaskFile) {
 	t.controlc <- updateMessage{tf}
 }
 
+// onInstanceRunning is called when in, the running instance, becomes
+// running: up for StableTime or, with notify, ready.
+//
+// run in Task.loop
+func (t *Task) onInstanceRunning(in *TaskInstance) {
+	t.stopPrevious("replaced by " + in.ID())
+	if argv := in.config.postStart; len(argv) > 0 {
+		go in.runPostHook("postStart", argv)
+	}
+}
+
 // run in Task.loop
 func (t *Task) onTaskFinished(m instanceGoneMessage) {
 	m.in.Printf("Task exited; err=%v", m.in.waitErr)
 	if m.in == t.running {
 		t.running = nil
 	}
+	if m.in == t.stopping {
+		t.stopping = nil
+	}
+	if m.in == t.previous {
+		t.previous = nil
+	}
 	const keepFailures = 5
 	if len(t.failures) == keepFailures {
 		copy(t.failures, t.failures[1:])
@@ -262,238 +443,481 @@ func (t *Task) onTaskFinished(m instanceGoneMessage) {
 	}
 	t.failures = append(t.failures, m.in)
 
-	aliveTime := m.in.endTime.Sub(m.in.startTime)
-	restartIn := 0 * time.Second
-	if min := 5 * time.Second; aliveTime < min {
-		restartIn = min - aliveTime
+	if prev := t.previous; t.running == nil && t.stopping == nil && t.preStarting == nil && prev != nil && prev.stopTime.IsZero() {
+		// The replacement in a rolling restart didn't make it.
+		t.running, t.previous = prev, nil
+		t.setState(StateRunning, "replacement %v; still running previous instance", m.in.exit)
+		return
+	}
+	if t.startPending && t.stopping == nil {
+		t.startPending = false
+		t.startInstance(t.config)
+		return
+	}
+	if t.running != nil || t.stopping != nil || t.preStarting != nil {
+		// Already replaced by a newer instance.
+		return
+	}
+	if t.operatorStopped {
+		t.setState(StateStopped, "stopped by operator; %v", m.in.exit.status())
+		return
+	}
+	if m.in.config.oneshot {
+		t.onJobFinished(m.in)
+		return
+	}
+	if m.in.stopKind != stopRequested {
+		t.restartRecovered(m.in)
+		return
+	}
+	if aliveTime := m.in.endTime.Sub(m.in.startTime); aliveTime >= t.restart.StableTime {
+		t.quickFails = 0
+	} else {
+		t.quickFails++
+	}
+
+	if !t.restart.shouldRestart(m.in.waitErr) {
+		t.setState(StateExited, "%v; restart policy is %q", m.in.exit, t.restart.Mode)
+		t.closeListeners(nil)
+		return
+	}
+	var exceeded bool
+	t.restarts, exceeded = t.restart.noteRestart(t.restarts, time.Now())
+	if exceeded {
+		t.setState(StateFailed, "restarted %d times within %v; giving up. Last %v",
+			len(t.restarts), t.restart.Window, m.in.exit)
+		m.in.Printf("Too many restarts; not restarting until reset by an operator or a config change")
+		t.closeListeners(nil)
+		return
 	}
+	restartIn := t.restart.delay(t.quickFails)
+	if t.quickFails >= crashLoopFails {
+		t.setState(StateCrashLooping, "%d consecutive instances exited within %v; last exited with %v",
+			t.quickFails, t.restart.StableTime, m.in.exit)
+	} else {
+		t.setState(StateBackingOff, "%v", m.in.exit)
+	}
+	m.in.Printf("Restarting in %v", restartIn)
+	t.scheduleRestart(restartIn)
+}
 
-	if m.in.waitErr == nil {
-		// TODO: vary restartIn based on whether this instance
-		// and the previous few completed successfully or not?
+// operatorStop stops the running instance, if any, and keeps the
+// task stopped until restartNow is called.
+//
+// run in Task.loop
+func (t *Task) operatorStop() <-chan struct{} {
+	t.operatorStopped = true
+	t.startPending = false
+	t.cancelRestart()
+	t.cancelRun()
+	done := t.stopAll("stopped by operator")
+	t.closeListeners(nil)
+	if t.stopping == nil {
+		t.setState(StateStopped, "stopped by operator")
 	}
+	return done
+}
 
-	time.AfterFunc(restartIn, func() {
-		t.controlc <- restartIfStoppedMessage{}
-	})
+// restartNow stops the running instance, if any, and starts a new one
+// as soon as it has exited. It also starts a stopped task.
+//
+// run in Task.loop
+func (t *Task) restartNow() error {
+	if t.config == nil {
+		return fmt.Errorf("task %q has no valid config", t.Name)
+	}
+	t.operatorStopped = false
+	t.quickFails = 0
+	t.jobRetries = 0
+	t.runQueued = false
+	t.restarts = nil
+	t.cancelRestart()
+	if t.canRoll(t.config) {
+		return t.rollInstance(t.config, "restarted by operator")
+	}
+	t.stopAll("restarted by operator")
+	if t.stopping != nil {
+		t.startPending = true
+		return nil
+	}
+	return t.startInstance(t.config)
+}
+
+// startNow is restartNow for a task without a running instance.
+//
+// run in Task.loop
+func (t *Task) startNow() error {
+	if t.running != nil || t.preStarting != nil {
+		return nil
+	}
+	if t.stopping != nil && t.config != nil {
+		t.operatorStopped = false
+		t.startPending = true
+		return nil
+	}
+	return t.restartNow()
+}
+
+// checkInstance returns an error if id is non-empty and isn't the ID
+// of the running instance.
+//
+// run in Task.loop
+func (t *Task) checkInstance(id string) error {
+	if id == "" {
+		return nil
+	}
+	if t.running == nil {
+		return fmt.Errorf("task %q has no running instance; wanted %s", t.Name, id)
+	}
+	if got := t.running.ID(); got != id {
+		return fmt.Errorf("task %q running instance is %s, not %s", t.Name, got, id)
+	}
+	return nil
 }
 
 // run in Task.loop
 func (t *Task) restartIfStopped() {
-	if t.running != nil || t.config == nil {
+	if t.running != nil || t.stopping != nil || t.preStarting != nil || t.config == nil || t.operatorStopped {
 		return
 	}
+	t.cancelRestart()
 	t.Printf("Restarting")
-	t.updateFromConfig(t.config)
+	t.startInstance(t.config)
 }
 
 // run in Task.loop
 func (t *Task) update(tf TaskFile) {
-	t.config = nil
-	t.stop()
-
 	fileName := tf.ConfigFileName()
 	if fileName == "" {
-		t.Printf("config file deleted; stopping")
-		DeleteTask(t.Name)
+		if t.replica == 0 {
+			t.syncReplicas(tf, 0)
+		}
+		t.remove("config file deleted")
 		return
 	}
 
+	// Parse and validate the new config before touching the
+	// running instance, so a bad edit doesn't take it down.
 	jc, err := jsonconfig.ReadFile(fileName)
 	if err != nil {
-		t.configError("Bad config file: %v", err)
+		t.rejectConfig(fmt.Errorf("Bad config file: %v", err))
+		return
+	}
+	tc, err := parseTaskConfig(jc, t.replica)
+	if err != nil {
+		t.rejectConfig(err)
+		return
+	}
+	if t.replica >= tc.instances {
+		t.remove(fmt.Sprintf("config now has %d instances", tc.instances))
+		return
+	}
+	if err := setTaskDeps(t.Name, tc); err != nil {
+		t.rejectConfig(err)
+		return
+	}
+	if t.replica == 0 {
+		t.syncReplicas(tf, tc.instances)
+	}
+	reuseChanged := t.config != nil && reusePortChanged(t.config, tc)
+	if t.config != nil && t.config.instances != tc.instances && sameConfigExcept(t.config.jc, tc.jc, "instances") && !reuseChanged {
+		t.config = tc
+		t.rejectErr = nil
+		t.Printf("instances changed to %d; not restarting", tc.instances)
+		return
+	}
+	if tc.oneshot && t.state == StateSucceeded && t.config != nil && sameConfigExcept(t.config.jc, tc.jc, "") {
+		t.config = tc
+		t.rejectErr = nil
+		t.Printf("config unchanged; not running again")
+		return
+	}
+	t.config = tc
+	t.configErr = nil
+	t.rejectErr = nil
+	t.restart = tc.restart
+	t.quickFails = 0
+	t.jobRetries = 0
+	t.restarts = nil
+	t.cancelRestart()
+	t.cancelRun()
+
+	if t.restoreHandover(tc) {
+		t.Printf("config unchanged since upgrade; staying %s", t.state)
+		return
+	}
+	if t.running == nil && t.stopping == nil && t.adoptOrphans(tc) {
 		return
 	}
-	t.updateFromConfig(jc)
+	if t.operatorStopped {
+		t.Printf("stopped by operator; not starting new config")
+		return
+	}
+	t.runQueued = false
+	if sc := tc.schedule; sc != nil {
+		// Let any run in progress finish.
+		if t.running != nil && t.running.config.schedule == nil {
+			t.stopAll("config changed to scheduled")
+		}
+		t.scheduleRun()
+		if t.running == nil && t.stopping == nil && t.preStarting == nil {
+			t.setState(StateScheduled, "%v; first run in %v", sc, t.runTime.Sub(time.Now()))
+		}
+		return
+	}
+	if t.canRoll(tc) && !reuseChanged {
+		t.rollInstance(tc, "config changed")
+		return
+	}
+	t.stopAll("config changed")
+	if t.stopping != nil {
+		t.Printf("waiting for previous instance to exit before starting new config")
+		t.startPending = true
+		return
+	}
+	t.startInstance(tc)
+}
+
+// remove stops the task and forgets it, for when its config file is
+// deleted or it's no longer one of the config's instances.
+//
+// run in Task.loop
+func (t *Task) remove(reason string) {
+	t.Printf("%s; stopping", reason)
+	t.config = nil
+	t.startPending = false
+	t.cancelRestart()
+	t.cancelRun()
+	t.stopAll(reason)
+	t.closeListeners(nil)
+	DeleteTask(t.Name)
+}
+
+// sameConfigExcept reports whether a and b are the same config file
+// contents, ignoring key.
+func sameConfigExcept(a, b jsonconfig.Obj, key string) bool {
+	without := func(jc jsonconfig.Obj) map[string]interface{} {
+		m := make(map[string]interface{}, len(jc))
+		for k, v := range jc {
+			if k != key {
+				m[k] = v
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(without(a), without(b))
+}
+
+// rejectConfig records err as the reason the config file on disk
+// couldn't be used. Any running instance keeps running with the
+// previous config.
+//
+// run in Task.loop
+func (t *Task) rejectConfig(err error) {
+	if t.config == nil {
+		killOrphans(t.Name, "its config is invalid")
+		t.configError("%v", err)
+		return
+	}
+	t.rejectErr = err
+	t.rejectTime = time.Now()
+	t.Printf("%v; keeping previous config", err)
 }
 
 // run in Task.loop
 func (t *Task) configError(format string, args ...interface{}) error {
 	t.configErr = fmt.Errorf(format, args...)
-	t.errTime = time.Now()
-	t.Printf("%v", t.configErr)
+	t.setState(StateConfigError, "%v", t.configErr)
 	return t.configErr
 }
 
 // run in Task.loop
 func (t *Task) startError(format string, args ...interface{}) error {
-	// TODO: make start error and config error different?
-	return t.configError(format, args...)
+	t.startErr = fmt.Errorf(format, args...)
+	t.setState(StateStartError, "%v", t.startErr)
+	return t.startErr
 }
 
+// startInstance starts a new instance with config tc, once its
+// dependencies are up and its preStart hook, if any, has succeeded.
+// There must not be a running instance.
+//
 // run in Task.loop
-func (t *Task) updateFromConfig(jc jsonconfig.Obj) (err error) {
-	t.config = nil
-	t.stop()
-
-	env := []string{}
-	stdEnv := jc.OptionalBool("standardEnv", true)
-
-	userStr := jc.OptionalString("user", "")
-	groupStr := jc.OptionalString("group", "")
-
-	// TODO: medium-term hack to run on linux/arm which lacks cgo support,
-	// so let users define these, even though user.Lookup will fail.
-	userErrUid := jc.OptionalString("userLookupErrUid", "")
-	userErrGid := jc.OptionalString("userLookupErrGid", "")
-	userErrHome := jc.OptionalString("userLookupErrHome", "")
-
-	// TODO: group? requires http://code.google.com/p/go/issues/detail?id=2617
-	var runas *user.User
-	if userStr != "" {
-		runas, err = user.Lookup(userStr)
-		if err != nil {
-			if userErrUid != "" {
-				runas = &user.User{
-					Uid:      userErrUid,
-					Gid:      userErrGid,
-					Username: userStr,
-					HomeDir:  userErrHome,
-				}
-			} else {
-				return t.configError("%v", err)
-			}
-		}
-		if stdEnv {
-			env = append(env, fmt.Sprintf("USER=%s", userStr))
-			env = append(env, fmt.Sprintf("HOME=%s", runas.HomeDir))
-		}
-	} else {
-		if stdEnv {
-			env = append(env, fmt.Sprintf("USER=%s", os.Getenv("USER")))
-			env = append(env, fmt.Sprintf("HOME=%s", os.Getenv("HOME")))
-		}
-	}
-
-	envMap := jc.OptionalObject("env")
-	envHas := func(k string) bool {
-		_, ok := envMap[k]
-		return ok
-	}
-	for k, v := range envMap {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+func (t *Task) startInstance(tc *taskConfig) error {
+	if unmet := unmetDeps(t, tc); unmet != "" {
+		t.setState(StateWaiting, "waiting for %s", unmet)
+		return nil
 	}
-	if stdEnv && !envHas("PATH") {
-		env = append(env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/bin:/usr/sbin:/sbin:/bin")
+	if len(tc.preStart) > 0 {
+		t.runPreStart(tc)
+		return nil
 	}
+	return t.launchInstance(tc)
+}
+
+// launchInstance opens tc's ports and starts a new instance with them.
+//
+// run in Task.loop
+func (t *Task) launchInstance(tc *taskConfig) error {
+	lr := *tc.lr
+	lr.Env = append([]string(nil), tc.lr.Env...)
+	lr.Env = append(lr.Env,
+		fmt.Sprintf("RUNSIT_INSTANCE=%d", t.replica),
+		fmt.Sprintf("RUNSIT_INSTANCES=%d", tc.instances))
 
 	extraFiles := []*os.File{}
-	ports := jc.OptionalObject("ports")
-	for portName, vi := range ports {
-		var ln net.Listener
-		var err error
-		switch v := vi.(type) {
-		case float64:
-			ln, err = net.Listen("tcp", ":"+strconv.Itoa(int(v)))
-		case string:
-			ln, err = net.Listen("tcp", v)
-		default:
-			return t.configError("port %q value must be a string or integer", portName)
-		}
+	for _, p := range tc.ports {
+		lf, err := t.listener(p)
 		if err != nil {
 			restartIn := 5 * time.Second
 			time.AfterFunc(restartIn, func() {
 				t.controlc <- updateMessage{t.tf}
 			})
-			return t.startError("port %q listen error: %v; restarting in %v", portName, err, restartIn)
+			return t.startError("port %q listen error: %v; restarting in %v", p.name, err, restartIn)
 		}
-		lf, err := ln.(*net.TCPListener).File()
-		if err != nil {
-			return t.startError("error getting file of port %q listener: %v", portName, err)
-		}
-		logger.Printf("opened port named %q on %v; fd=%d", portName, vi, lf.Fd())
-		ln.Close()
-		env = append(env, fmt.Sprintf("RUNSIT_PORTFD_%s=%d", portName, 3+len(extraFiles)))
+		lr.Env = append(lr.Env, fmt.Sprintf("RUNSIT_PORTFD_%s=%d", p.name, 3+len(extraFiles)))
 		extraFiles = append(extraFiles, lf)
-		defer lf.Close()
-	}
-
-	bin := jc.RequiredString("binary")
-	dir := jc.OptionalString("cwd", "")
-	args := jc.OptionalList("args")
-	groups := jc.OptionalList("groups")
-	numFiles := jc.OptionalInt("numFiles", 0)
-	if err := jc.Validate(); err != nil {
-		return t.configError("configuration error: %v", err)
 	}
-	t.config = jc
 
-	finalBin := bin
-	if !filepath.IsAbs(bin) {
-		dirAbs, err := filepath.Abs(dir)
-		if err != nil {
-			return t.configError("finding absolute path of dir %q: %v", dir, err)
+	var cg *cgroup
+	if *cgroupRoot != "" {
+		var err error
+		if cg, err = newCgroup(t.Name, tc.limits); err != nil {
+			return t.startError("error creating cgroup: %v", err)
 		}
-		finalBin = filepath.Clean(filepath.Join(dirAbs, bin))
+		lr.Cgroup = cg.dir
 	}
 
-	_, err = os.Stat(finalBin)
+	sio, err := newInstanceIO(t.Name)
 	if err != nil {
-		return t.configError("stat of binary %q failed: %v", bin, err)
-	}
-
-	argv := []string{filepath.Base(bin)}
-	argv = append(argv, args...)
-
-	lr := &LaunchRequest{
-		Path:     bin,
-		Env:      env,
-		Dir:      dir,
-		Argv:     argv,
-		NumFiles: numFiles,
-	}
-
-	if runas != nil {
-		lr.Uid = atoi(runas.Uid)
-		lr.Gid = atoi(runas.Gid)
-	}
-	if groupStr != "" {
-		gid, err := LookupGroupId(groupStr)
-		if err != nil {
-			return t.configError("error looking up group %q: %v", groupStr, err)
+		if cg != nil {
+			cg.remove()
 		}
-		lr.Gid = gid // primary group
+		return t.startError("error creating output and notify pipes: %v", err)
 	}
-
-	// supplemental groups:
-	for _, group := range groups {
-		gid, err := LookupGroupId(group)
-		if err != nil {
-			return t.configError("error looking up group %q: %v", group, err)
-		}
-		lr.Gids = append(lr.Gids, gid)
+	defer sio.closeChildEnds()
+	lr.Env = append(lr.Env, fmt.Sprintf("RUNSIT_NOTIFY_FD=%d", 3+len(extraFiles)))
+	if tc.watchdog > 0 {
+		lr.Env = append(lr.Env, fmt.Sprintf("RUNSIT_WATCHDOG_SEC=%g", tc.watchdog.Seconds()))
 	}
+	extraFiles = append(extraFiles, sio.notifyw)
 
-	cmd, outPipe, errPipe, err := lr.start(extraFiles)
+	cmd, err := lr.command(extraFiles)
+	if err == nil {
+		cmd.Stdout, cmd.Stderr = sio.outw, sio.errw
+		err = startChild(cmd)
+	}
 	if err != nil {
+		sio.close()
+		if cg != nil {
+			cg.remove()
+		}
 		return t.startError("failed to start: %v", err)
 	}
 
 	instance := &TaskInstance{
-		task:      t,
-		config:    jc,
-		startTime: time.Now(),
-		lr:        lr,
-		cmd:       cmd,
+		task:        t,
+		config:      tc,
+		startTime:   time.Now(),
+		lr:          &lr,
+		cmd:         cmd,
+		io:          sio,
+		cgroup:      cg,
+		stopSignal:  tc.stopSignal,
+		stopTimeout: tc.stopTimeout,
+		done:        make(chan struct{}),
 	}
 
-	t.Printf("started with PID %d", instance.Pid())
+	t.startErr = nil
 	t.running = instance
-	go instance.watchPipe(outPipe, "stdout")
-	go instance.watchPipe(errPipe, "stderr")
+	t.closeListeners(tc)
+	t.starts++
+	t.healthChecked, t.healthFails, t.healthErr = false, 0, nil
+	trackProcessTree(instance.Pid())
+	recordInstance(instance)
+	t.setState(StateStarting, "started with PID %d", instance.Pid())
+	time.AfterFunc(tc.restart.StableTime, func() {
+		t.controlc <- instanceUpMessage{instance}
+	})
+	go instance.watchPipe(sio.outr, "stdout")
+	go instance.watchPipe(sio.errr, "stderr")
 	go instance.awaitDeath()
+	go instance.watchNotify(sio.notifyr)
+	if tc.notify && tc.readyTimeout > 0 {
+		time.AfterFunc(tc.readyTimeout, func() {
+			t.controlc <- readyTimeoutMessage{instance}
+		})
+	}
+	if tc.health != nil {
+		go instance.checkHealth(tc.health)
+	}
+	if tc.watchdog > 0 {
+		instance.scheduleWatchdogCheck(tc.watchdog)
+	}
+	if tc.maxRuntime > 0 {
+		instance.scheduleMaxRuntime(tc.maxRuntime)
+	}
 	return nil
 }
 
 // run in its own goroutine
 func (in *TaskInstance) awaitDeath() {
-	in.waitErr = in.cmd.Wait()
+	if in.adopted != nil {
+		in.waitErr = in.awaitAdopted()
+	} else {
+		in.waitErr = in.cmd.Wait()
+	}
+	forgetChild(in.Pid())
 	in.endTime = time.Now()
+	oomKills := 0
+	if cg := in.cgroup; cg != nil {
+		if n := cg.killAll(); n > 0 {
+			in.Printf("main process exited; killed %d remaining processes in its cgroup", n)
+		}
+		oomKills = cg.oomKills()
+		cg.remove()
+	} else {
+		in.killRemaining()
+	}
+	in.mu.Lock()
+	in.exit = newExitInfo(in.cmd.ProcessState, in.endTime.Sub(in.startTime), in.stopReason)
+	in.exit.OOMKills = oomKills
+	in.mu.Unlock()
+	untrackProcessTree(in.Pid())
+	forgetInstance(in)
+	in.io.remove()
+	close(in.done)
+	if argv := in.config.postStop; len(argv) > 0 {
+		in.runPostHook("postStop", argv)
+	}
 	in.task.controlc <- instanceGoneMessage{in}
 }
 
+// Exited reports whether the instance has exited, and if so, when
+// and with what error. It's safe to call from any goroutine.
+func (in *TaskInstance) Exited() (exited bool, endTime time.Time, waitErr error) {
+	select {
+	case <-in.done:
+		return true, in.endTime, in.waitErr
+	default:
+		return false, time.Time{}, nil
+	}
+}
+
+// Exit returns how the instance ended, or nil if it's still running.
+// It's safe to call from any goroutine.
+func (in *TaskInstance) Exit() *exitInfo {
+	select {
+	case <-in.done:
+		return in.exit
+	default:
+		return nil
+	}
+}
+
 // run in its own goroutine
-func (in *TaskInstance) watchPipe(r io.Reader, name string) {
+func (in *TaskInstance) watchPipe(r io.ReadCloser, name string) {
+	defer r.Close()
 	br := bufio.NewReader(r)
 	for {
 		sl, isPrefix, err := br.ReadLine()
@@ -505,6 +929,8 @@ func (in *TaskInstance) watchPipe(r io.Reader, name string) {
 			in.Printf("pipe %q closed: %v", name, err)
 			return
 		}
+		atomic.AddInt64(&in.task.outputLines, 1)
+		atomic.AddInt64(&in.task.outputBytes, int64(len(sl)))
 		in.output.Add(&Line{
 			T:        time.Now(),
 			Name:     name,
@@ -513,56 +939,229 @@ func (in *TaskInstance) watchPipe(r io.Reader, name string) {
 			instance: in,
 		})
 	}
-	panic("unreachable")
 }
 
+// Stop stops the task's running instance, if any, and returns once
+// it has exited. The task stays stopped until Start or Restart is
+// called.
 func (t *Task) Stop() error {
+	return t.StopInstance("")
+}
+
+// StopInstance is like Stop, but fails unless the running instance's
+// ID is id.
+func (t *Task) StopInstance(id string) error {
 	errc := make(chan error, 1)
-	t.controlc <- stopMessage{errc}
+	t.controlc <- stopMessage{id, errc}
 	return <-errc
 }
 
+// Restart stops the task's running instance, if any, and starts a new
+// one once it has exited. A task stopped by Stop is started again.
+func (t *Task) Restart() error {
+	return t.RestartInstance("")
+}
+
+// RestartInstance is like Restart, but fails unless the running
+// instance's ID is id.
+func (t *Task) RestartInstance(id string) error {
+	errc := make(chan error, 1)
+	t.controlc <- restartMessage{id, errc}
+	return <-errc
+}
+
+// Start starts the task if it isn't running, including if it was
+// stopped by Stop or has failed. It does nothing to a running task.
+func (t *Task) Start() error {
+	errc := make(chan error, 1)
+	t.controlc <- startMessage{errc}
+	return <-errc
+}
+
+// stop asks the running instance to exit, without waiting for it to
+// do so. The returned channel is closed once the instance is gone.
+// The reason is recorded in the instance's exitInfo.
+//
 // runs in Task.loop
-func (t *Task) stop() error {
+func (t *Task) stop(reason string) <-chan struct{} {
+	t.preStarting = nil
 	in := t.running
 	if in == nil {
-		return nil
+		if t.stopping != nil {
+			return t.stopping.done
+		}
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	t.running = nil
+	t.stopping = in
+	state := StateStopping
+	if in.stopKind == stopHung {
+		// Stay hung until it's gone.
+		state = StateHung
+	}
+	t.setState(state, "%s; sent %v", reason, signalName(in.stopSignal))
+	in.requestStop(reason)
+	return in.done
+}
+
+// requestStop sends the instance its stop signal, escalating to
+// SIGKILL if it doesn't exit in time. The reason is recorded in its
+// exitInfo.
+//
+// runs in Task.loop
+func (in *TaskInstance) requestStop(reason string) {
+	in.stopTime = time.Now()
+	in.mu.Lock()
+	in.stopReason = reason
+	in.mu.Unlock()
+	in.Printf("%s; sending %v", reason, signalName(in.stopSignal))
+	in.signal(in.stopSignal)
+	if in.stopSignal != syscall.SIGKILL {
+		go in.awaitStop()
 	}
+}
 
-	// TODO: more graceful kill types
-	in.Printf("sending SIGKILL")
+// awaitStop escalates to SIGKILL if the instance hasn't exited within
+// its stop timeout.
+//
+// run in its own goroutine
+func (in *TaskInstance) awaitStop() {
+	timer := time.NewTimer(in.stopTimeout)
+	defer timer.Stop()
+	select {
+	case <-in.done:
+		return
+	case <-timer.C:
+	}
+	in.Printf("still running %v after %v; sending SIGKILL", in.stopTimeout, signalName(in.stopSignal))
+	in.signal(syscall.SIGKILL)
+}
 
-	// Was: in.cmd.Process.Kill(); but we want to kill
-	// the entire process group.
+// signal sends sig to every process in the instance's cgroup or, if it
+// has none, to its entire process group and the rest of its process
+// tree.
+func (in *TaskInstance) signal(sig syscall.Signal) {
+	if in.cgroup != nil {
+		in.cgroup.signal(sig)
+		return
+	}
 	processGroup := 0 - in.Pid()
-	rv := syscall.Kill(processGroup, 9)
-	in.Printf("Kill result: %v", rv)
-	t.running = nil
-	return nil
+	if err := syscall.Kill(processGroup, sig); err != nil {
+		in.Printf("Kill(%d, %v) error: %v", processGroup, signalName(sig), err)
+	}
+	in.signalTree(sig)
+}
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+
+	// Not useful as stopSignal, but named when they kill an instance:
+	"SIGILL":  syscall.SIGILL,
+	"SIGABRT": syscall.SIGABRT,
+	"SIGBUS":  syscall.SIGBUS,
+	"SIGFPE":  syscall.SIGFPE,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGPIPE": syscall.SIGPIPE,
+	"SIGALRM": syscall.SIGALRM,
+}
+
+// signalByName returns the signal named name, with or without its
+// "SIG" prefix.
+func signalByName(name string) (sig syscall.Signal, ok bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok = signals[name]
+	return
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
 }
 
 // TaskStatus is an one-time snapshot of a task's status, for rendering in
 // the web UI.
 type TaskStatus struct {
+	State       TaskState
+	StateTime   time.Time // when State was entered
+	StateReason string    // why State was entered
+
 	Running  *TaskInstance   // or nil, if none running
+	Previous *TaskInstance   // or nil; instance Running is replacing in a rolling restart
+	Stopping *TaskInstance   // or nil, if none is being stopped
 	StartErr error           // if a task is not running, the reason why it failed to start
 	ErrTime  time.Time       // time of StartErr
 	StartIn  time.Duration   // non-zero if task is rate-limited and will restart in this time
 	Failures []*TaskInstance // past few failures
+	History  []TaskEvent     // recent state changes, oldest first
+
+	Health string // running instance's health check result, or "" if none
+
+	// From the running instance's notify FD:
+	Ready        bool      // sent READY=1
+	StatusText   string    // last STATUS=
+	WatchdogTime time.Time // last WATCHDOG=1, or zero
+
+	Oneshot  bool   // runs to completion; see oneshot.go
+	Schedule string // describes when a scheduled task runs, or ""
+	Replica  int    // index among its config's instances
+	Replicas int    // the config's instances, or 0 if it has no valid config
+
+	Restarts   int               // instances started after the first
+	Hangs      int               // instances stopped as hung for missing a watchdog keepalive
+	QuickFails int               // consecutive instances that exited before becoming stable
+	Labels     map[string]string // from the config's "labels"; don't modify
+
+	// ConfigErr is set if the config file on disk was rejected
+	// and the previous config is still in use.
+	ConfigErr     error
+	ConfigErrTime time.Time // time of ConfigErr
+}
+
+// StateAge returns how long the task has been in its current state.
+func (s *TaskStatus) StateAge() time.Duration {
+	return time.Now().Sub(s.StateTime)
 }
 
 func (s *TaskStatus) Summary() string {
-	in := s.Running
-	if in != nil {
-		return "ok"
+	sum := fmt.Sprintf("%v for %v", s.State, s.StateAge())
+	if s.StateReason != "" {
+		sum += ": " + s.StateReason
+	}
+	if s.StatusText != "" {
+		sum += fmt.Sprintf("; status %q", s.StatusText)
+	}
+	if s.Health != "" {
+		sum += "; health check " + s.Health
+	}
+	if s.Hangs > 0 {
+		sum += fmt.Sprintf("; hung %d times", s.Hangs)
+	}
+	if s.StartIn > 0 {
+		if s.Schedule != "" {
+			sum += fmt.Sprintf("; next run in %v", s.StartIn)
+		} else {
+			sum += fmt.Sprintf("; restarting in %v", s.StartIn)
+		}
 	}
-	if err := s.StartErr; err != nil {
-		return fmt.Sprintf("Start error (%v ago): %v", time.Now().Sub(s.ErrTime), err)
+	if err := s.ConfigErr; err != nil {
+		sum += fmt.Sprintf("; config error (%v ago), using previous config: %v", time.Now().Sub(s.ConfigErrTime), err)
 	}
-	// TODO: flesh these not running states out.
-	// e.g. intentionaly stopped, how long we're pausing before
-	// next re-start attempt, etc.
-	return "not running"
+	return sum
 }
 
 // Status returns the task's status.
@@ -576,19 +1175,74 @@ func (t *Task) Status() *TaskStatus {
 func (t *Task) status() *TaskStatus {
 	failures := make([]*TaskInstance, len(t.failures))
 	copy(failures, t.failures)
+	history := make([]TaskEvent, len(t.history))
+	copy(history, t.history)
 	s := &TaskStatus{
+		State:       t.state,
+		StateTime:   t.stateTime,
+		StateReason: t.stateReason,
+
 		Running:  t.running,
+		Previous: t.previous,
+		Stopping: t.stopping,
 		Failures: failures,
+		History:  history,
+
+		Replica:    t.replica,
+		QuickFails: t.quickFails,
+		Hangs:      t.hangs,
+
+		ConfigErr:     t.rejectErr,
+		ConfigErrTime: t.rejectTime,
+	}
+	if t.starts > 0 {
+		s.Restarts = t.starts - 1
+	}
+	if in := t.running; in != nil {
+		s.Ready, s.StatusText, s.WatchdogTime = in.ready, in.statusText, in.watchdogTime
+	}
+	if t.running != nil && t.running.config.health != nil {
+		switch {
+		case !t.healthChecked:
+			s.Health = "not yet checked"
+		case t.healthFails == 0:
+			s.Health = "healthy"
+		default:
+			s.Health = fmt.Sprintf("failing (%d of %d): %v", t.healthFails, t.running.config.health.threshold, t.healthErr)
+		}
+	}
+	if t.config != nil {
+		s.Labels = t.config.labels
+		s.Replicas = t.config.instances
+		s.Oneshot = t.config.oneshot
+		if sc := t.config.schedule; sc != nil {
+			s.Schedule = sc.String()
+		}
+	}
+	switch t.state {
+	case StateConfigError:
+		s.StartErr, s.ErrTime = t.configErr, t.stateTime
+	case StateStartError:
+		s.StartErr, s.ErrTime = t.startErr, t.stateTime
 	}
 	if t.running == nil {
-		s.StartErr = t.configErr
-		s.ErrTime = t.errTime
+		next := t.restartTime
+		if next.IsZero() {
+			next = t.runTime
+		}
+		if d := next.Sub(time.Now()); !next.IsZero() && d > 0 {
+			s.StartIn = d
+		}
 	}
 	return s
 }
 
 func watchConfigDir() {
 	for tf := range dirWatcher().Updates() {
+		if strings.Contains(tf.Name(), replicaSep) {
+			logger.Printf("Ignoring config file for %q: task names may not contain %q", tf.Name(), replicaSep)
+			continue
+		}
 		t := GetOrMakeTask(tf.Name(), tf)
 		go t.Update(tf)
 	}
@@ -610,6 +1264,7 @@ func DeleteTask(name string) {
 	tasksMu.Lock()
 	defer tasksMu.Unlock()
 	delete(tasks, name)
+	forgetTask(name)
 }
 
 // GetOrMakeTask returns or create the named task.
@@ -659,13 +1314,18 @@ func handleSignals() {
 		switch s {
 		case os.Interrupt, os.Signal(syscall.SIGTERM):
 			logger.Printf("Got signal %q; stopping all tasks.", s)
-			for _, t := range GetTasks() {
-				t.Stop()
-			}
+			stopAllTasks()
 			logger.Printf("Tasks all stopped after %s; quitting.", s)
 			os.Exit(0)
+		case os.Signal(syscall.SIGUSR2):
+			logger.Printf("Got signal %q; upgrading.", s)
+			go func() {
+				if err := upgrade(); err != nil {
+					logger.Printf("Upgrade failed: %v", err)
+				}
+			}()
 		case os.Signal(syscall.SIGCHLD):
-			// Ignore.
+			requestReap()
 		default:
 			logger.Printf("unhandled signal: %T %#v", s, s)
 		}
@@ -675,21 +1335,61 @@ func handleSignals() {
 func main() {
 	MaybeBecomeChildProcess()
 	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(runClient(flag.Args()))
+	}
 
-	listenAddr := "localhost"
-	if a := os.Getenv("RUNSIT_LISTEN"); a != "" {
-		listenAddr = a
+	h := readHandover()
+	var ln net.Listener
+	if h != nil {
+		ln = h.listener(h.AdminFD)
+		adminSocketListener = h.listener(h.AdminSocketFD)
+	} else {
+		var err error
+		ln, err = net.Listen("tcp", fmt.Sprintf("%s:%d", listenHost(), *httpPort))
+		if err != nil {
+			logger.Printf("Error listening on port %d: %v", *httpPort, err)
+			os.Exit(1)
+			return
+		}
 	}
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenAddr, *httpPort))
-	if err != nil {
-		logger.Printf("Error listening on port %d: %v", *httpPort, err)
-		os.Exit(1)
-		return
+	adminListener = ln
+	if *tlsCert != "" {
+		if *tlsKey == "" {
+			logger.Fatalf("--tls_cert requires --tls_key")
+		}
+		cr, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{GetCertificate: cr.GetCertificate})
 	}
 	logger.Printf("Listening on port %d", *httpPort)
+	if *adminAuthFile == "" && listenHost() != "localhost" {
+		logger.Printf("Warning: HTTP admin port is reachable from other hosts without --admin_auth_file")
+	}
 
+	switch {
+	case h != nil:
+		h.restore()
+	case *stateDir != "":
+		loadState()
+	}
+	if *adminSocket != "" && adminSocketListener == nil {
+		adminSocketListener = listenAdminSocket(*adminSocket)
+	}
+	if *cgroupRoot != "" {
+		if err := initCgroups(); err != nil {
+			logger.Fatalf("cgroup_root: %v", err)
+		}
+	}
+	startReaper()
 	go handleSignals()
 	go watchConfigDir()
 	go runWebServer(ln)
+	go sampleProcStats()
+	if adminSocketListener != nil {
+		go runAdminSocket(adminSocketListener)
+	}
 	select {}
 }
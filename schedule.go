@@ -0,0 +1,213 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Scheduled tasks. A config with a "schedule" object is a oneshot
+// task that's run periodically instead of once:
+//
+//   "schedule": {
+//     "cron": "*/15 * * * *",   a cron expression (see cronSchedule), or
+//     "everySec": 900,          a fixed interval from each run's start
+//     "timezone": "UTC",        for cron; default is runsit's local time
+//     "jitterSec": 30,          delay each run by up to this much
+//     "overlap": "skip"         if the previous run is still going when
+//                               the next is due: "skip" the new run,
+//                               "queue" it until the previous exits, or
+//                               "kill" the previous run and start anew
+//   }
+//
+// Between runs, the task is scheduled. Failed runs aren't retried
+// unless "retries" is set; "maxRuntimeSec" limits how long each run
+// may take. Each run is a new TaskInstance, kept with its output
+// among the task's recent runs. A retry doesn't move the next run.
+// Tasks that "require" a scheduled task only wait for it to be
+// between runs.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// Overlap policies.
+const (
+	overlapSkip  = "skip"
+	overlapQueue = "queue"
+	overlapKill  = "kill"
+)
+
+type schedule struct {
+	cron    *cronSchedule // or nil, to run every every
+	every   time.Duration
+	loc     *time.Location
+	jitter  time.Duration
+	overlap string // overlapSkip, overlapQueue or overlapKill
+}
+
+// parseSchedule parses a "schedule" block. It returns nil if jc is
+// empty.
+func parseSchedule(jc jsonconfig.Obj) (*schedule, error) {
+	if len(jc) == 0 {
+		return nil, nil
+	}
+	expr := jc.OptionalString("cron", "")
+	tz := jc.OptionalString("timezone", "")
+	s := &schedule{
+		every:   seconds(jc.OptionalFloat("everySec", 0)),
+		jitter:  seconds(jc.OptionalFloat("jitterSec", 0)),
+		overlap: jc.OptionalString("overlap", overlapSkip),
+		loc:     time.Local,
+	}
+	if err := jc.Validate(); err != nil {
+		return nil, err
+	}
+	if (expr == "") == (s.every == 0) {
+		return nil, errors.New(`exactly one of "cron" or "everySec" is required`)
+	}
+	if s.every < 0 || s.jitter < 0 {
+		return nil, errors.New("everySec and jitterSec must not be negative")
+	}
+	switch s.overlap {
+	case overlapSkip, overlapQueue, overlapKill:
+	default:
+		return nil, fmt.Errorf("unknown overlap policy %q; want %q, %q or %q",
+			s.overlap, overlapSkip, overlapQueue, overlapKill)
+	}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, err
+		}
+		s.loc = loc
+	}
+	if expr != "" {
+		c, err := parseCron(expr)
+		if err != nil {
+			return nil, err
+		}
+		if c.next(time.Now().In(s.loc)).IsZero() {
+			return nil, fmt.Errorf("cron expression %q never matches", expr)
+		}
+		s.cron = c
+	}
+	return s, nil
+}
+
+func (s *schedule) String() string {
+	if s.cron == nil {
+		return fmt.Sprintf("every %v", s.every)
+	}
+	return fmt.Sprintf("cron %q (%v)", s.cron, s.loc)
+}
+
+// next returns when the run after one at now is due.
+func (s *schedule) next(now time.Time) time.Time {
+	var t time.Time
+	if s.cron != nil {
+		t = s.cron.next(now.In(s.loc))
+	} else {
+		t = now.Add(s.every)
+	}
+	if s.jitter > 0 {
+		t = t.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+	}
+	return t
+}
+
+// runDueMessage is sent by the next run's timer. It's stale, and
+// ignored, unless gen is still the task's runGen.
+type runDueMessage struct {
+	gen int
+}
+
+// scheduleRun arranges for the task's next scheduled run. Retries of
+// a failed run use the restart timer instead, so don't delay it.
+//
+// run in Task.loop
+func (t *Task) scheduleRun() {
+	t.scheduleRunAt(t.config.schedule.next(time.Now()))
+}
+
+// run in Task.loop
+func (t *Task) scheduleRunAt(at time.Time) {
+	t.cancelRun()
+	gen := t.runGen
+	t.runTime = at
+	t.runTimer = time.AfterFunc(at.Sub(time.Now()), func() {
+		t.controlc <- runDueMessage{gen}
+	})
+}
+
+// run in Task.loop
+func (t *Task) cancelRun() {
+	if t.runTimer != nil {
+		t.runTimer.Stop()
+		t.runTimer = nil
+	}
+	t.runTime = time.Time{}
+	t.runGen++
+}
+
+// onRunDue starts a scheduled run, applying the schedule's overlap
+// policy if the previous run is still going or being stopped. A
+// pending retry of the previous run is dropped in favour of the new
+// run.
+//
+// run in Task.loop
+func (t *Task) onRunDue() {
+	if t.config == nil || t.config.schedule == nil || t.operatorStopped {
+		return
+	}
+	sc := t.config.schedule
+	switch in := t.running; {
+	case in == nil && t.stopping == nil && t.preStarting == nil:
+		t.cancelRestart()
+		t.jobRetries = 0
+		t.startInstance(t.config)
+	case t.startPending || t.preStarting != nil:
+		t.Printf("a run is already about to start; skipping scheduled run")
+	case sc.overlap == overlapSkip:
+		t.Printf("previous run still going; skipping scheduled run")
+	case sc.overlap == overlapQueue:
+		t.runQueued = true
+		t.Printf("previous run still going; queueing scheduled run")
+	default:
+		t.stop("next scheduled run due")
+		t.startPending = true
+	}
+	t.scheduleRun()
+}
+
+// finishRun records the result of a scheduled task's run, once it
+// won't be retried, and starts a queued run or schedules the next.
+//
+// run in Task.loop
+func (t *Task) finishRun(in *TaskInstance) {
+	t.jobRetries = 0
+	if t.runTimer == nil {
+		t.scheduleRun()
+	}
+	t.setState(StateScheduled, "last run %v after %v; next run in %v",
+		in.exit, in.exit.Duration, t.runTime.Sub(time.Now()))
+	if t.runQueued {
+		t.runQueued = false
+		t.startInstance(t.config)
+	}
+}
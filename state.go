@@ -0,0 +1,165 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TaskState is the lifecycle state of a Task.
+type TaskState int
+
+const (
+	// StateNew means the task was just created and hasn't yet
+	// acted on its config file.
+	StateNew TaskState = iota
+
+	// StateStarting means an instance was launched but hasn't yet
+	// been up for its restart policy's StableTime (or, for tasks
+	// with "notify" set, sent READY=1). Oneshot tasks stay starting
+	// until their instance exits.
+	StateStarting
+
+	// StateRunning means an instance is up and considered healthy.
+	StateRunning
+
+	// StateBackingOff means the last instance exited and a restart
+	// is scheduled.
+	StateBackingOff
+
+	// StateCrashLooping is like StateBackingOff, but the last
+	// several instances all exited shortly after starting.
+	StateCrashLooping
+
+	// StateStopping means the instance was sent its stop signal
+	// and hasn't exited yet.
+	StateStopping
+
+	// StateStopped means an operator stopped the task. It stays
+	// stopped until it's explicitly started again.
+	StateStopped
+
+	// StateExited means the last instance exited and, per the
+	// task's restart policy, won't be restarted.
+	StateExited
+
+	// StateConfigError means the task has no usable config.
+	StateConfigError
+
+	// StateStartError means the config is fine but launching an
+	// instance failed.
+	StateStartError
+
+	// StateFailed means the task restarted too often within its
+	// restart policy's window and was given up on. It stays failed
+	// until restarted by an operator or its config changes.
+	StateFailed
+
+	// StateHung means the instance missed its watchdog keepalive
+	// and is being stopped, to be restarted once it has exited.
+	StateHung
+
+	// StateWaiting means the task is ready to start an instance but
+	// is waiting for tasks it depends on to come up.
+	StateWaiting
+
+	// StateSucceeded means a oneshot task's instance exited
+	// successfully. It isn't run again until its config changes or
+	// it's restarted by an operator.
+	StateSucceeded
+
+	// StateScheduled means a scheduled task is waiting for its next
+	// run. Its reason says how the last run went.
+	StateScheduled
+)
+
+var stateNames = []string{
+	StateNew:          "new",
+	StateStarting:     "starting",
+	StateRunning:      "running",
+	StateBackingOff:   "backing-off",
+	StateCrashLooping: "crash-looping",
+	StateStopping:     "stopping",
+	StateStopped:      "stopped-by-operator",
+	StateExited:       "exited",
+	StateConfigError:  "config-error",
+	StateStartError:   "start-error",
+	StateFailed:       "failed",
+	StateHung:         "hung",
+	StateWaiting:      "waiting",
+	StateSucceeded:    "succeeded",
+	StateScheduled:    "scheduled",
+}
+
+func (s TaskState) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("TaskState(%d)", int(s))
+}
+
+// MarshalText encodes s by name, so states handed over to an upgraded
+// runsit (see upgrade.go) survive the list of states changing.
+func (s TaskState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *TaskState) UnmarshalText(b []byte) error {
+	for i, name := range stateNames {
+		if name == string(b) {
+			*s = TaskState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown task state %q", b)
+}
+
+// crashLoopFails is how many consecutive quick failures move a task
+// from StateBackingOff to StateCrashLooping.
+const crashLoopFails = 3
+
+// TaskEvent is an entry in a task's history.
+type TaskEvent struct {
+	T      time.Time
+	State  TaskState // state entered
+	Reason string
+}
+
+// keepHistory is the number of TaskEvents kept per task.
+const keepHistory = 50
+
+// setState moves the task to state s, recording when and why.
+//
+// run in Task.loop
+func (t *Task) setState(s TaskState, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	now := time.Now()
+	if s != t.state {
+		t.Printf("state %v -> %v: %s", t.state, s, reason)
+		t.stateTime = now
+	}
+	t.state = s
+	t.stateReason = reason
+	publishState(t.Name, s)
+
+	if len(t.history) == keepHistory {
+		copy(t.history, t.history[1:])
+		t.history = t.history[:keepHistory-1]
+	}
+	t.history = append(t.history, TaskEvent{T: now, State: s, Reason: reason})
+}
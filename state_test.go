@@ -0,0 +1,54 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTaskStateZero(t *testing.T) {
+	var s TaskState
+	if s != StateNew || s.String() != "new" {
+		t.Errorf("zero TaskState = %v; want new", s)
+	}
+}
+
+func TestTaskStateJSON(t *testing.T) {
+	for i, name := range stateNames {
+		s := TaskState(i)
+		if name == "" {
+			t.Errorf("TaskState(%d) has no name", i)
+			continue
+		}
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `"` + name + `"`; string(b) != want {
+			t.Errorf("Marshal(%v) = %s; want %s", s, b, want)
+		}
+		var got TaskState
+		if err := json.Unmarshal(b, &got); err != nil || got != s {
+			t.Errorf("Unmarshal(%s) = %v, %v; want %v", b, got, err, s)
+		}
+	}
+	var s TaskState
+	if err := json.Unmarshal([]byte(`"bogus"`), &s); err == nil {
+		t.Errorf("Unmarshal of unknown state succeeded")
+	}
+}
@@ -28,6 +28,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/bradfitz/runsit/listen"
 )
 
 var (
@@ -97,6 +99,12 @@ func main() {
 	fmt.Fprintf(os.Stdout, "Hello on stdout; listening on port %d\n", *port)
 	fmt.Fprintf(os.Stderr, "Hello on stderr\n")
 	go logNoise()
+	if err := listen.Status(fmt.Sprintf("serving on port %d", *port)); err != nil {
+		log.Printf("notify status: %v", err)
+	}
+	if err := listen.Ready(); err != nil {
+		log.Printf("notify ready: %v", err)
+	}
 
 	http.HandleFunc("/crash", crashHandler)
 	http.HandleFunc("/", statusHandler)
@@ -0,0 +1,522 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// In-place upgrades. On SIGUSR2, "runsit upgrade" or a POST to
+// /api/v1/upgrade, runsit re-execs its binary (typically a new version
+// installed at the same path) without stopping any task. The new
+// process keeps runsit's PID, so instances stay its children, and
+// inherits:
+//
+//   the admin HTTP listener and the --admin_socket listener
+//   each task's held port listeners
+//   runsit's ends of each live instance's stdout, stderr and notify FD
+//   each task's state, history, counters, pending restart or run,
+//     and recent failures, and each live instance's recent output
+//
+// The new runsit then reads the config files and adopts the instances
+// much as after a restart (see adopt.go), but as their parent it still
+// learns how they exit. A task that had exited, failed or succeeded
+// stays that way unless its config changed. If the exec fails, the old
+// runsit carries on.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// upgradeFDEnv names the FD of the handover file in the new process.
+const upgradeFDEnv = "_RUNSIT_UPGRADE_FD"
+
+// handover is runsit's state, as passed to its upgraded self.
+type handover struct {
+	AdminFD       int // admin HTTP listener
+	AdminSocketFD int // --admin_socket listener, or -1
+	Log           string
+	Tasks         []*taskHandover
+}
+
+type taskHandover struct {
+	Name            string
+	State           TaskState
+	StateTime       time.Time
+	StateReason     string
+	ConfigHash      string // of the config State is for, or ""
+	OperatorStopped bool
+	Starts          int
+	Hangs           int
+	QuickFails      int
+	JobRetries      int
+	Restarts        []time.Time
+	RestartTime     time.Time // pending restart, or zero
+	RunTime         time.Time // scheduled: next run, or zero
+	History         []TaskEvent
+	Failures        []*pastHandover
+	Listeners       map[string]int // port addr -> FD
+	Instances       []*instanceHandover
+}
+
+// pastHandover is one of a task's recent failures (or, for oneshot
+// tasks, runs).
+type pastHandover struct {
+	Pid      int
+	Argv     []string
+	NumFiles int
+	Started  time.Time
+	Ended    time.Time
+	WaitErr  string // or "" if it exited successfully
+	Exit     *exitInfo
+	Output   []*Line
+}
+
+// Roles of handed-over instances.
+const (
+	roleRunning  = "running"
+	rolePrevious = "previous" // being replaced by a rolling restart
+	roleStopping = "stopping"
+)
+
+type instanceHandover struct {
+	instanceRecord
+	Role       string
+	Child      bool // runsit's child, rather than adopted after a restart
+	Ready      bool
+	StatusText string
+	StopTime   time.Time
+	StopReason string
+	StopKind   stopKind
+	StdoutFD   int // runsit's ends, or -1 if closed
+	StderrFD   int
+	NotifyFD   int
+	Output     []*Line
+}
+
+var (
+	adminListener       net.Listener // admin HTTP listener, before any TLS
+	adminSocketListener net.Listener // or nil
+)
+
+// handoverMessage asks a task for its state, to hand over in an
+// upgrade. The task then waits for resume, which is only closed if
+// the upgrade fails.
+type handoverMessage struct {
+	pass   func(*os.File) int // returns the FD at which the new process gets the file
+	resc   chan<- *taskHandover
+	resume <-chan struct{}
+}
+
+// run in Task.loop
+func (t *Task) handover(pass func(*os.File) int) *taskHandover {
+	h := &taskHandover{
+		Name:            t.Name,
+		State:           t.state,
+		StateTime:       t.stateTime,
+		StateReason:     t.stateReason,
+		OperatorStopped: t.operatorStopped,
+		Starts:          t.starts,
+		Hangs:           t.hangs,
+		QuickFails:      t.quickFails,
+		JobRetries:      t.jobRetries,
+		Restarts:        t.restarts,
+		RestartTime:     t.restartTime,
+		RunTime:         t.runTime,
+		History:         t.history,
+		Listeners:       make(map[string]int),
+	}
+	if t.config != nil {
+		h.ConfigHash = t.config.hash
+	}
+	for _, in := range t.failures {
+		ph := &pastHandover{
+			Pid:      in.Pid(),
+			Argv:     in.lr.Argv,
+			NumFiles: in.lr.NumFiles,
+			Started:  in.startTime,
+			Ended:    in.endTime,
+			Exit:     in.exit,
+			Output:   in.Output(),
+		}
+		if in.waitErr != nil {
+			ph.WaitErr = in.waitErr.Error()
+		}
+		h.Failures = append(h.Failures, ph)
+	}
+	for addr, lf := range t.listeners {
+		h.Listeners[addr] = pass(lf)
+	}
+	for _, ir := range []struct {
+		in   *TaskInstance
+		role string
+	}{{t.running, roleRunning}, {t.previous, rolePrevious}, {t.stopping, roleStopping}} {
+		if in := ir.in; in != nil && in.Exit() == nil {
+			h.Instances = append(h.Instances, in.handover(ir.role, pass))
+		}
+	}
+	return h
+}
+
+// run in Task.loop
+func (in *TaskInstance) handover(role string, pass func(*os.File) int) *instanceHandover {
+	start, _, _ := procIdentity(in.Pid())
+	in.mu.Lock()
+	stopReason := in.stopReason
+	in.mu.Unlock()
+	return &instanceHandover{
+		instanceRecord: instanceRecord{
+			Task:       in.task.Name,
+			Pid:        in.Pid(),
+			Pgid:       in.Pid(),
+			ProcStart:  start,
+			Started:    in.startTime,
+			ConfigHash: in.config.hash,
+			Dir:        in.io.dir,
+			Cgroup:     in.cgroupDir(),
+		},
+		Role:       role,
+		Child:      in.adopted == nil || in.adopted.child(),
+		Ready:      in.ready,
+		StatusText: in.statusText,
+		StopTime:   in.stopTime,
+		StopReason: stopReason,
+		StopKind:   in.stopKind,
+		StdoutFD:   pass(in.io.outr),
+		StderrFD:   pass(in.io.errr),
+		NotifyFD:   pass(in.io.notifyr),
+		Output:     in.Output(),
+	}
+}
+
+var upgradeMu sync.Mutex // held while upgrading
+
+// upgradeBinary returns the path of the binary to re-exec.
+func upgradeBinary() (string, error) {
+	return exec.LookPath(os.Args[0])
+}
+
+// upgrade re-execs runsit's binary, handing over every task. It only
+// returns if that fails, in which case runsit carries on as before.
+func upgrade() error {
+	upgradeMu.Lock()
+	defer upgradeMu.Unlock()
+	bin, err := upgradeBinary()
+	if err != nil {
+		return err
+	}
+
+	var passed []int      // duplicate FDs for the new process to inherit
+	var opened []*os.File // by upgrade
+	var passErr error
+	defer func() {
+		for _, fd := range passed {
+			syscall.Close(fd)
+		}
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+	// pass duplicates f's FD rather than using f.Fd, which would
+	// put it in blocking mode. The duplicate is close-on-exec until
+	// just before the exec, so no child started meanwhile gets it.
+	pass := func(f *os.File) int {
+		if f == nil {
+			return -1
+		}
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return -1
+		}
+		dup := -1
+		if rc.Control(func(fd uintptr) {
+			syscall.ForkLock.RLock()
+			defer syscall.ForkLock.RUnlock()
+			nfd, err := syscall.Dup(int(fd))
+			if err != nil {
+				passErr = err
+				return
+			}
+			syscall.CloseOnExec(nfd)
+			dup = nfd
+		}) != nil {
+			return -1 // closed
+		}
+		if dup >= 0 {
+			passed = append(passed, dup)
+		}
+		return dup
+	}
+	listenerFile := func(ln net.Listener) (*os.File, error) {
+		fl, ok := ln.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("can't hand over %T", ln)
+		}
+		f, err := fl.File()
+		if err == nil {
+			opened = append(opened, f)
+		}
+		return f, err
+	}
+
+	h := &handover{AdminSocketFD: -1}
+	f, err := listenerFile(adminListener)
+	if err != nil {
+		return err
+	}
+	h.AdminFD = pass(f)
+	if adminSocketListener != nil {
+		f, err := listenerFile(adminSocketListener)
+		if err != nil {
+			return err
+		}
+		h.AdminSocketFD = pass(f)
+	}
+
+	// Freeze every task while collecting its state, so nothing
+	// changes before the exec.
+	resume := make(chan struct{})
+	defer close(resume)
+	for _, t := range GetTasks() {
+		resc := make(chan *taskHandover)
+		t.controlc <- handoverMessage{pass, resc, resume}
+		h.Tasks = append(h.Tasks, <-resc)
+	}
+
+	hf, err := ioutil.TempFile("", "runsit-upgrade")
+	if err != nil {
+		return err
+	}
+	opened = append(opened, hf)
+	os.Remove(hf.Name())
+	logger.Printf("Upgrading: re-execing %s", bin)
+	h.Log = logBuf.String()
+	if err := json.NewEncoder(hf).Encode(h); err != nil {
+		return err
+	}
+	if _, err := hf.Seek(0, 0); err != nil {
+		return err
+	}
+	env := append(os.Environ(), fmt.Sprintf("%s=%d", upgradeFDEnv, pass(hf)))
+	if passErr != nil {
+		return fmt.Errorf("duplicating FD: %v", passErr)
+	}
+	syscall.ForkLock.Lock()
+	defer syscall.ForkLock.Unlock()
+	for _, fd := range passed {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0); errno != 0 {
+			return fmt.Errorf("clearing close-on-exec: %v", errno)
+		}
+	}
+	err = syscall.Exec(bin, os.Args, env)
+	return fmt.Errorf("exec %s: %v", bin, err)
+}
+
+var (
+	handoverMu  sync.Mutex
+	handedTasks = map[string]*taskHandover{} // not yet restored, guarded by handoverMu
+)
+
+// readHandover returns the state handed over by the runsit this
+// process was upgraded from, or nil if it wasn't.
+func readHandover() *handover {
+	v := os.Getenv(upgradeFDEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Fatalf("bad %s %q", upgradeFDEnv, v)
+	}
+	f := inheritedFile(fd, "handover")
+	defer f.Close()
+	h := new(handover)
+	if err := json.NewDecoder(f).Decode(h); err != nil {
+		logger.Fatalf("Error reading upgrade handover: %v", err)
+	}
+	logBuf.Write([]byte(h.Log))
+	logger.Printf("Upgraded; taking over %d tasks", len(h.Tasks))
+	return h
+}
+
+// inheritedFile returns the file at fd, inherited from the process
+// runsit was upgraded from, or nil if fd is -1.
+func inheritedFile(fd int, name string) *os.File {
+	if fd < 0 {
+		return nil
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), name)
+}
+
+// listener returns the inherited listener at fd, or nil if fd is -1.
+func (h *handover) listener(fd int) net.Listener {
+	f := inheritedFile(fd, "listener")
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		logger.Fatalf("Error taking over listener: %v", err)
+	}
+	return ln
+}
+
+// restore makes the handed-over instances orphans, to be adopted by
+// their tasks, and the rest of each task's state ready for its first
+// config update.
+func (h *handover) restore() {
+	handoverMu.Lock()
+	defer handoverMu.Unlock()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, th := range h.Tasks {
+		handedTasks[th.Name] = th
+		for _, ih := range th.Instances {
+			r := &ih.instanceRecord
+			r.up = ih
+			if !r.alive() {
+				// Exited during the upgrade. Reap it.
+				if p, err := os.FindProcess(r.Pid); err == nil && ih.Child {
+					p.Wait()
+				}
+				logger.Printf("Instance of %q with PID %d exited during the upgrade", r.Task, r.Pid)
+				continue
+			}
+			if ih.Child {
+				addChild(r.Pid)
+			}
+			records[r.Pid] = r
+			orphans[r.Task] = append(orphans[r.Task], r)
+		}
+	}
+	for _, rs := range orphans {
+		sort.Sort(byRecordStarted(rs))
+	}
+	saveStateLocked()
+}
+
+// io returns the inherited instanceIO of a handed-over instance.
+func (ih *instanceHandover) io() *instanceIO {
+	return &instanceIO{
+		dir:     ih.Dir,
+		outr:    inheritedFile(ih.StdoutFD, "stdout"),
+		errr:    inheritedFile(ih.StderrFD, "stderr"),
+		notifyr: inheritedFile(ih.NotifyFD, "notify"),
+	}
+}
+
+// restoreHandover restores the state of the task handed over by an
+// upgrade, the first time it's called. If the task's config is still
+// tc, its restart counters and any pending restart or scheduled run
+// carry over too. It reports whether the task had exited, failed or
+// succeeded, or was waiting to start again, with config tc, and so
+// should stay that way.
+//
+// run in Task.loop
+func (t *Task) restoreHandover(tc *taskConfig) bool {
+	handoverMu.Lock()
+	h := handedTasks[t.Name]
+	delete(handedTasks, t.Name)
+	handoverMu.Unlock()
+	if h == nil {
+		return false
+	}
+	t.state, t.stateTime, t.stateReason = h.State, h.StateTime, h.StateReason
+	t.history = h.History
+	t.operatorStopped = h.OperatorStopped
+	t.starts, t.hangs = h.Starts, h.Hangs
+	publishState(t.Name, t.state)
+	for addr, fd := range h.Listeners {
+		if t.listeners == nil {
+			t.listeners = make(map[string]*os.File)
+		}
+		t.listeners[addr] = inheritedFile(fd, addr)
+	}
+	t.closeListeners(tc)
+	for _, ph := range h.Failures {
+		t.failures = append(t.failures, ph.instance(t, tc))
+	}
+	if h.ConfigHash != tc.hash {
+		return false
+	}
+	t.quickFails, t.jobRetries, t.restarts = h.QuickFails, h.JobRetries, h.Restarts
+	if !h.RunTime.IsZero() && tc.schedule != nil {
+		t.scheduleRunAt(h.RunTime)
+	}
+	if len(h.Instances) > 0 {
+		return false
+	}
+	if !h.RestartTime.IsZero() {
+		t.scheduleRestart(h.RestartTime.Sub(time.Now()))
+		return true
+	}
+	switch h.State {
+	case StateExited, StateFailed, StateSucceeded:
+		return true
+	case StateScheduled:
+		return t.runTimer != nil
+	}
+	return false
+}
+
+// instance recreates the finished instance ph describes.
+func (ph *pastHandover) instance(t *Task, tc *taskConfig) *TaskInstance {
+	proc, _ := os.FindProcess(ph.Pid) // never fails on Unix
+	in := &TaskInstance{
+		task:      t,
+		startTime: ph.Started,
+		config:    tc,
+		lr:        &LaunchRequest{Argv: ph.Argv, NumFiles: ph.NumFiles},
+		cmd:       &exec.Cmd{Process: proc},
+		done:      make(chan struct{}),
+		endTime:   ph.Ended,
+		exit:      ph.Exit,
+	}
+	if ph.WaitErr != "" {
+		in.waitErr = errors.New(ph.WaitErr)
+	}
+	close(in.done)
+	in.output.restore(in, ph.Output)
+	return in
+}
+
+// restore adds lines handed over by an upgrade to the output, keeping
+// their Seqs. The output must be empty.
+func (to *TaskOutput) restore(in *TaskInstance, lines []*Line) {
+	if len(lines) == 0 {
+		return
+	}
+	to.mu.Lock()
+	to.n = lines[0].Seq - 1
+	to.mu.Unlock()
+	for _, l := range lines {
+		l.instance = in
+		to.Add(l)
+	}
+}
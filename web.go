@@ -24,7 +24,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -45,19 +44,30 @@ func killTask(w http.ResponseWriter, r *http.Request, t *Task) {
 		http.Error(w, "task not running", 500)
 		return
 	}
-	pid, _ := strconv.Atoi(r.FormValue("pid"))
-	if in.Pid() != pid || pid == 0 {
-		http.Error(w, "active task pid doesn't match pid parameter", 500)
+	id := r.FormValue("instance")
+	if id == "" || id != in.ID() {
+		http.Error(w, "running instance doesn't match instance parameter", 500)
+		return
+	}
+	if err := t.StopInstance(id); err != nil {
+		http.Error(w, err.Error(), 500)
 		return
 	}
-	t.Stop()
 	drawTemplate(w, "killTask", tmplData{
 		"Title": "Kill",
 		"Task":  t,
-		"PID":   pid,
+		"PID":   in.Pid(),
 	})
 }
 
+func restartTask(w http.ResponseWriter, r *http.Request, t *Task) {
+	if err := t.Restart(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, "/task/"+t.Name, http.StatusFound)
+}
+
 func taskView(w http.ResponseWriter, r *http.Request) {
 	taskName := r.URL.Path[len("/task/"):]
 	t, ok := GetTask(taskName)
@@ -66,10 +76,17 @@ func taskView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	mode := r.FormValue("mode")
+	if mode != "" && !validCSRF(r) {
+		http.Error(w, "bad or missing csrf token", http.StatusForbidden)
+		return
+	}
 	switch mode {
 	case "kill":
 		killTask(w, r, t)
 		return
+	case "restart":
+		restartTask(w, r, t)
+		return
 	default:
 		http.Error(w, "unknown mode", 400)
 		return
@@ -79,16 +96,25 @@ func taskView(w http.ResponseWriter, r *http.Request) {
 	data := tmplData{
 		"Title": t.Name + " status",
 		"Task":  t,
+		"CSRF":  csrfToken(r),
 	}
 
 	st := t.Status()
+	data["Status"] = st
 	in := st.Running
 	if in != nil {
 		data["PID"] = in.Pid()
+		data["InstanceID"] = in.ID()
 		data["Output"] = in.Output()
 		data["Cmd"] = in.lr
 		data["StartTime"] = in.startTime
 		data["StartAgo"] = time.Now().Sub(in.startTime)
+		data["Stats"] = in.Stats()
+		data["NumFiles"] = in.lr.NumFiles
+		if st.ConfigErr != nil {
+			data["ConfigErr"] = st.ConfigErr
+			data["ConfigErrAgo"] = time.Now().Sub(st.ConfigErrTime)
+		}
 	}
 
 	// list failures in reverse-chronological order
@@ -100,19 +126,48 @@ func taskView(w http.ResponseWriter, r *http.Request) {
 		}
 		data["Failures"] = r
 	}
+	{
+		h := st.History
+		r := make([]TaskEvent, len(h))
+		for i := range h {
+			r[len(r)-i-1] = h[i]
+		}
+		data["History"] = r
+	}
 
 	drawTemplate(w, "viewTask", data)
 }
 
-func runWebServer(ln net.Listener) {
+// adminHandler returns the handler for the admin web pages, API,
+// and metrics.
+func adminHandler() http.Handler {
 	mux := http.NewServeMux()
-	// TODO: wrap mux in auth handler, making it available only to
-	// TCP connections from localhost and owned by the uid/gid of
-	// the running process.
 	mux.HandleFunc("/", taskList)
 	mux.HandleFunc("/task/", taskView)
+	mux.HandleFunc(apiPrefix, apiHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	return mux
+}
+
+// isMutating reports whether r asks to change a task's state.
+func isMutating(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/task/") && r.FormValue("mode") != ""
+}
+
+func runWebServer(ln net.Listener) {
+	h := checkMutation(adminHandler())
+	if *adminAuthFile != "" {
+		auth, err := loadHTTPAuth(*adminAuthFile)
+		if err != nil {
+			logger.Fatalf("admin_auth_file: %v", err)
+		}
+		h = auth.handler(h)
+	}
 	s := &http.Server{
-		Handler: mux,
+		Handler: h,
 	}
 	err := s.Serve(ln)
 	if err != nil {
@@ -165,6 +220,16 @@ const rootHTML = `
 		.output div.system {
 		   color: #00c;
 		}
+		.error {
+		   color: #c00;
+		}
+		form.action {
+		   display: inline;
+		}
+		table.stats td, table.stats th {
+		   padding: 0 0.5em;
+		   text-align: right;
+		}
                 .topbar {
                     font-family: sans;
                     font-size: 10pt;
@@ -187,8 +252,10 @@ var templateHTML = map[string]string{
 	{{define "body"}}
 		<h2>Running</h2>
 		<ul>
-		{{range .Tasks}}
-			<li><a href='/task/{{.Name}}'>{{.Name}}</a>: {{maybePre .Status.Summary}}</li>
+		{{range $t := .Tasks}}
+			{{with .Status}}
+			<li><a href='/task/{{$t.Name}}'>{{$t.Name}}</a>: {{maybePre .Summary}}{{with .Running}}{{with .Stats}}; {{.}}{{end}}{{end}}</li>
+			{{end}}
 		{{end}}
 		</ul>
 		<h2>Log</h2>
@@ -203,7 +270,15 @@ var templateHTML = map[string]string{
 `,
 	"viewTask": `
 	{{define "body"}}
-		<p>{{maybePre .Task.Status.Summary}}</p>
+		<p>{{maybePre .Status.Summary}}
+		{{if not .Status.Running}}{{if not .Status.Stopping}}
+		<form method='POST' action='/task/{{.Task.Name}}' class='action'>
+			<input type='hidden' name='mode' value='restart'>
+			<input type='hidden' name='csrf' value='{{.CSRF}}'>
+			<input type='submit' value='restart'>
+		</form>
+		{{end}}{{end}}
+		</p>
 
 		{{with .Cmd}}
 		{{/* TODO: embolden arg[0] */}}
@@ -213,14 +288,56 @@ var templateHTML = map[string]string{
 		{{if .PID}}
 		<h2>Running Instance</h2>
                 <p>Started {{.StartTime}}, {{.StartAgo}} ago.</p>
-		<p>PID={{.PID}} [<a href='/task/{{.Task.Name}}?pid={{.PID}}&mode=kill'>kill</a>]</p>
+		<p>PID={{.PID}}
+		<form method='POST' action='/task/{{.Task.Name}}' class='action'>
+			<input type='hidden' name='mode' value='kill'>
+			<input type='hidden' name='instance' value='{{.InstanceID}}'>
+			<input type='hidden' name='csrf' value='{{.CSRF}}'>
+			<input type='submit' value='kill'>
+		</form>
+		</p>
+		{{with .Status.Previous}}
+		<p>Replacing PID={{.Pid}}, which is stopped once this instance is up.</p>
+		{{end}}
+		{{with .Stats}}
+		<table class='stats'>
+			<tr><th>PID</th><th>PPID</th><th>command</th><th>RSS</th><th>CPU</th><th>threads</th><th>FDs</th><th>FD limit</th></tr>
+			{{range .Procs}}
+			<tr><td>{{.Pid}}</td><td>{{.PPid}}</td><td style='padding-left: {{.Depth}}em'>{{.Comm}}</td><td>{{formatBytes .RSS}}</td><td>{{.CPU}}</td><td>{{.Threads}}</td><td>{{.FDs}}</td>
+			<td{{if $.NumFiles}}{{if ne .FDLimit $.NumFiles}} class='error' title='numFiles is {{$.NumFiles}}'{{end}}{{end}}>{{.FDLimit}}</td></tr>
+			{{end}}
+			{{if gt (len .Procs) 1}}{{with .Total}}
+			<tr><th colspan='3'>total</th><th>{{formatBytes .RSS}}</th><th>{{.CPU}}</th><th>{{.Threads}}</th><th>{{.FDs}}</th><th></th></tr>
+			{{end}}{{end}}
+		</table>
+		<p>Sampled {{.Time}}{{if $.NumFiles}}; numFiles is {{$.NumFiles}}{{end}}.</p>
+		{{end}}
+		{{with .ConfigErr}}
+		<p class='error'>Config file rejected {{$.ConfigErrAgo}} ago; still running the previous config:</p>
+		{{maybePre .Error}}
+		{{end}}
 		{{end}}
 
 		{{with .Output}}{{template "output" .}}{{end}}
 
 		{{with .Failures}}
-		<h2>Failures</h2>
-		{{range .}}{{template "output" .Output}}{{end}}
+		<h2>{{if $.Status.Oneshot}}Runs{{else}}Failures{{end}}</h2>
+		{{range .}}
+		{{with .Exit}}
+		<h3>{{.}}</h3>
+		<p>{{.Usage}}</p>
+		{{end}}
+		{{template "output" .Output}}
+		{{end}}
+		{{end}}
+
+		{{with .History}}
+		<h2>History</h2>
+		<table>
+		{{range .}}
+			<tr><td>{{.T}}</td><td>{{.State}}</td><td>{{.Reason}}</td></tr>
+		{{end}}
+		</table>
 		{{end}}
 
 		<script>
@@ -243,8 +360,9 @@ var templateHTML = map[string]string{
 }
 
 var templateFuncs = template.FuncMap{
-	"maybeQuote": maybeQuote,
-	"maybePre":   maybePre,
+	"maybeQuote":  maybeQuote,
+	"maybePre":    maybePre,
+	"formatBytes": formatBytes,
 }
 
 func maybeQuote(s string) string {